@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// eventAggregator collects events in memory instead of sending them to a backend
+type eventAggregator interface {
+	Add(events []auditapi.Event)
+}
+
+// aggregateSource is audit logs aggregated in memory, only one of the fields is set
+type aggregateSource struct {
+	ProwJob     string
+	AuditLogDir string
+	Input       string
+}
+
+// parseAggregateSource detects whether source is a Prow job URL, an archive, a dir or a file with audit logs
+func parseAggregateSource(source string) (aggregateSource, error) {
+	if isRemoteInput(source) {
+		if sourceURL, err := url.Parse(source); err == nil {
+			if _, err := parseProwJobURL(sourceURL); err == nil {
+				return aggregateSource{ProwJob: source}, nil
+			}
+		}
+		return aggregateSource{Input: source}, nil
+	}
+	if source == stdinPath || isArchiveInput(source) {
+		return aggregateSource{Input: source}, nil
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return aggregateSource{}, err
+	}
+	if info.IsDir() {
+		return aggregateSource{AuditLogDir: source}, nil
+	}
+	return aggregateSource{Input: source}, nil
+}
+
+func (s aggregateSource) String() string {
+	switch {
+	case len(s.ProwJob) > 0:
+		return s.ProwJob
+	case len(s.AuditLogDir) > 0:
+		return s.AuditLogDir
+	default:
+		return s.Input
+	}
+}
+
+// aggregateFlags stores command line flags shared by commands aggregating audit logs in memory
+type aggregateFlags struct {
+	step           string
+	concurrency    int
+	onParseError   string
+	onlyDuringTest bool
+	cacheDir       string
+	noCache        bool
+	cacheStreamed  bool
+}
+
+func addAggregateFlags(fs *flag.FlagSet) *aggregateFlags {
+	f := &aggregateFlags{}
+	fs.StringVar(&f.step, "step", "", "glob matching step or target/step of the prow job to import audit logs from, '*' for all steps, defaults to the gather step of e2e target")
+	fs.IntVar(&f.concurrency, "concurrency", 1, "number of audit log files processed simultaneously")
+	fs.StringVar(&f.onParseError, "on-parse-error", onParseErrorFail, fmt.Sprintf("what to do with malformed audit log lines: %s, %s or %s", onParseErrorFail, onParseErrorSkip, onParseErrorQuarantine))
+	fs.BoolVar(&f.onlyDuringTest, "only-during-test", false, "drop events of prow job runs outside of the time between job start and finish")
+	fs.StringVar(&f.cacheDir, "cache-dir", defaultDownloadCacheDir(), "directory storing downloaded prow job artifacts")
+	fs.BoolVar(&f.noCache, "no-cache", false, "download zip archives to temp dir instead of the cache")
+	fs.BoolVar(&f.cacheStreamed, "cache-streamed", false, "keep streamed prow job artifacts in the cache, by default they are streamed without using disk")
+	return f
+}
+
+// aggregateConfig stores settings for aggregating audit logs in memory
+type aggregateConfig struct {
+	Step           string
+	Concurrency    int
+	Parse          ParseConfig
+	OnlyDuringTest bool
+	// Strict fails the aggregation if any audit log file couldn't be read or parsed
+	Strict bool
+	// Cache stores downloaded artifacts, streamed artifacts are stored only if it caches them
+	Cache *downloadCache
+}
+
+// AggregateConfig validates flags and opens download cache
+func (f *aggregateFlags) AggregateConfig(logger *logrus.Logger) (aggregateConfig, error) {
+	conf := aggregateConfig{
+		Step:           f.step,
+		Concurrency:    f.concurrency,
+		Parse:          ParseConfig{OnError: f.onParseError},
+		OnlyDuringTest: f.onlyDuringTest,
+	}
+	if err := validateParseConfig(conf.Parse); err != nil {
+		return conf, err
+	}
+	if f.noCache {
+		return conf, nil
+	}
+	var err error
+	conf.Cache, err = openDownloadCache(logger, f.cacheDir, defaultCacheMaxSize*1024*1024)
+	if err != nil {
+		return conf, err
+	}
+	conf.Cache.streamed = f.cacheStreamed
+	return conf, nil
+}
+
+// aggregate sends audit logs of the source to the aggregator. Files which failed to parse are reported
+// but don't fail the aggregation unless it's strict. Info of the run is returned if the source is a Prow job
+func aggregate(ctx context.Context, logger *logrus.Logger, aggregator eventAggregator, conf aggregateConfig, source aggregateSource) (ProwInfo, error) {
+	var prowInfo ProwInfo
+	sinks := newSinkTracker(logger)
+	ingestConf := IngestConfig{
+		SinkName:       sinkReport,
+		Sink:           SinkConfig{Aggregator: aggregator},
+		ProwJob:        source.ProwJob,
+		Concurrency:    conf.Concurrency,
+		Parse:          conf.Parse,
+		BaseDir:        source.AuditLogDir,
+		OnlyDuringTest: conf.OnlyDuringTest,
+	}
+	var err error
+	switch {
+	case len(source.ProwJob) > 0:
+		var prowjobURL *url.URL
+		prowjobURL, err = url.Parse(source.ProwJob)
+		if err != nil {
+			return prowInfo, err
+		}
+		prowInfo, err = newArtifactLocator(logger).Locate(prowjobURL)
+		if err != nil {
+			return prowInfo, err
+		}
+		err = streamRun(ctx, logger, sinks, ingestConf, conf.Cache, prowInfo, conf.Step)
+	case len(source.Input) > 0 && isArchiveInput(source.Input):
+		err = ingestArchive(ctx, logger, sinks, ingestConf, conf.Cache, source.Input)
+	case len(source.Input) > 0:
+		err = ingestFiles(ctx, logger, sinks, ingestConf, []string{source.Input})
+	case source.AuditLogDir == stdinPath:
+		err = ingestFiles(ctx, logger, sinks, ingestConf, []string{stdinPath})
+	case len(source.AuditLogDir) > 0:
+		var auditLogFiles []string
+		auditLogFiles, err = findAuditLogsInDir(logger, source.AuditLogDir)
+		if err != nil {
+			return prowInfo, err
+		}
+		err = ingestFiles(ctx, logger, sinks, ingestConf, auditLogFiles)
+	default:
+		return prowInfo, fmt.Errorf("no audit logs source set")
+	}
+	if err != nil {
+		if ctx.Err() != nil || conf.Strict {
+			return prowInfo, errors.Join(err, sinks.CloseAll())
+		}
+		logger.Warning(err)
+	}
+	return prowInfo, sinks.CloseAll()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/melbahja/got"
+	"github.com/sirupsen/logrus"
+)
+
+// mustGatherAuditLogsDir contains audit logs in must-gather, e.g. audit_logs/kube-apiserver/<node>/<file>.log.gz
+const mustGatherAuditLogsDir = "audit_logs"
+
+var (
+	tarExtensions = []string{".tar", ".tar.gz", ".tgz"}
+	zipExtension  = ".zip"
+)
+
+// isRemoteInput returns true if input is an http(s) URL
+func isRemoteInput(input string) bool {
+	return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://")
+}
+
+// isArchiveInput returns true if input is a local or remote tar or zip archive rather than an audit log
+func isArchiveInput(input string) bool {
+	if isRemoteInput(input) {
+		return true
+	}
+	return isZipInput(input) || isTarInput(input)
+}
+
+func isZipInput(input string) bool {
+	return strings.HasSuffix(strings.ToLower(input), zipExtension)
+}
+
+func isTarInput(input string) bool {
+	lower := strings.ToLower(input)
+	for _, ext := range tarExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestArchive sends audit logs from members of local or remote archive without extracting them to disk.
+// Archives which are not zip are read as tar, compressed or not
+func ingestArchive(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, cache *downloadCache, input string) error {
+	if len(conf.Parse.QuarantineDir) == 0 {
+		// Streamed audit logs have no dir to put quarantine file next to
+		conf.Parse.QuarantineDir = "."
+	}
+	a := newArchiveIngest(logger, sinks, conf, input, nil)
+	logger.WithFields(logrus.Fields{"input": input}).Info("Streaming audit logs")
+	if isZipInput(input) {
+		if err := streamZip(ctx, logger, cache, a, input); err != nil {
+			return err
+		}
+		return a.Finish(ctx)
+	}
+
+	var (
+		body io.ReadCloser
+		err  error
+	)
+	if isRemoteInput(input) {
+		body, err = openArtifact(ctx, cache, input)
+	} else {
+		body, err = os.Open(input)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	archive, err := decompress(body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", input, err)
+	}
+	defer archive.Close()
+	streamTarMembers(ctx, a, archive, archiveMemberName)
+	return a.Finish(ctx)
+}
+
+// streamZip sends audit logs from zip members. Zip can't be read sequentially, so remote archive
+// is downloaded to the cache or temp file first
+func streamZip(ctx context.Context, logger *logrus.Logger, cache *downloadCache, a *archiveIngest, input string) error {
+	zipPath := input
+	if isRemoteInput(input) {
+		var err error
+		zipPath, err = fetchArchive(logger, cache, input)
+		if err != nil {
+			return err
+		}
+		if cache == nil {
+			defer os.RemoveAll(filepath.Dir(zipPath))
+		}
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", input, err)
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !isAuditLogMember(f.Name) {
+			continue
+		}
+		open := func() (io.ReadCloser, error) {
+			member, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			reader, err := decompress(member)
+			if err != nil {
+				member.Close()
+				return nil, err
+			}
+			return &readCloser{
+				Reader: reader,
+				close: func() error {
+					reader.Close()
+					return member.Close()
+				},
+			}, nil
+		}
+		a.Ingest(ctx, f.Name, archiveMemberName(f.Name), int64(f.UncompressedSize64), open)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// fetchArchive downloads remote zip archive to the cache or to a temp dir if cache is not set
+func fetchArchive(logger *logrus.Logger, cache *downloadCache, archiveURL string) (string, error) {
+	if cache != nil {
+		return cache.Fetch(archiveURL)
+	}
+	dir, err := os.MkdirTemp("", "audit-span")
+	if err != nil {
+		return "", err
+	}
+	archivePath := filepath.Join(dir, "archive"+zipExtension)
+	logger.WithFields(logrus.Fields{"url": archiveURL, "path": archivePath}).Info("Downloading")
+	if err := got.New().Download(archiveURL, archivePath); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return archivePath, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// mustGatherMembers are files of must-gather audit_logs dir
+var mustGatherMembers = []string{
+	"must-gather.local.1/quay-io-image/audit_logs/kube-apiserver/master-0/audit.log.gz",
+	"must-gather.local.1/quay-io-image/audit_logs/oauth-apiserver/master-1/audit-2024-09-16T10-00-00.000.log.gz",
+	"must-gather.local.1/quay-io-image/audit_logs/kube-apiserver.audit_logs_listing",
+	"must-gather.local.1/quay-io-image/namespaces/default/default.yaml",
+}
+
+func TestIsAuditLogMember(t *testing.T) {
+	for name, expected := range map[string]bool{
+		mustGatherMembers[0]:                              true,
+		mustGatherMembers[1]:                              true,
+		mustGatherMembers[2]:                              false,
+		mustGatherMembers[3]:                              false,
+		"audit_logs/kube-apiserver/master-0-audit.log.gz": true,
+		"master-0-audit.log.gz":                           false,
+	} {
+		if isAuditLogMember(name) != expected {
+			t.Errorf("expected isAuditLogMember(%s) to be %v", name, expected)
+		}
+	}
+}
+
+func TestIsArchiveInput(t *testing.T) {
+	for input, expected := range map[string]bool{
+		"must-gather.tar.gz":                true,
+		"audit-logs.tar":                    true,
+		"logs.ZIP":                          true,
+		"https://example.com/audit-logs":    true,
+		"audit.log.gz":                      false,
+		"/var/log/kube-apiserver/audit.log": false,
+	} {
+		if isArchiveInput(input) != expected {
+			t.Errorf("expected isArchiveInput(%s) to be %v", input, expected)
+		}
+	}
+}
+
+// ingestTestArchive streams archive and returns filenames of opened streams with the number of their events
+func ingestTestArchive(t *testing.T, input string) map[string]int {
+	t.Helper()
+	resetRecordedSinks()
+	conf := IngestConfig{
+		SinkName: testSinkName,
+		Parse:    failOnParseError,
+	}
+	sinks := newSinkTracker(testLogger())
+	if err := ingestArchive(context.Background(), testLogger(), sinks, conf, nil, input); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinks.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	recordedSinks.Lock()
+	defer recordedSinks.Unlock()
+	result := map[string]int{}
+	for i, labels := range recordedSinks.labels {
+		result[labels["filename"]] = len(recordedSinks.sinks[i].events)
+	}
+	return result
+}
+
+func checkMustGatherStreams(t *testing.T, streams map[string]int) {
+	t.Helper()
+	expected := []string{"kube-apiserver/master-0/audit.log", "oauth-apiserver/master-1/audit-2024-09-16T10-00-00.000.log"}
+	names := []string{}
+	for name, events := range streams {
+		names = append(names, name)
+		if events != 2 {
+			t.Errorf("expected 2 events in %s, got %d", name, events)
+		}
+	}
+	sort.Strings(names)
+	if len(names) != len(expected) || names[0] != expected[0] || names[1] != expected[1] {
+		t.Errorf("expected streams %v, got %v", expected, names)
+	}
+}
+
+func TestIngestMustGatherTar(t *testing.T) {
+	member := gzipBytes(t, []byte(testAuditLog))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range mustGatherMembers {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(member))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(t.TempDir(), "must-gather.tar.gz")
+	if err := os.WriteFile(input, gzipBytes(t, buf.Bytes()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMustGatherStreams(t, ingestTestArchive(t, input))
+}
+
+func TestIngestRemoteZip(t *testing.T) {
+	member := gzipBytes(t, []byte(testAuditLog))
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range mustGatherMembers {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "must-gather.zip", time.Now(), bytes.NewReader(buf.Bytes()))
+	}))
+	t.Cleanup(server.Close)
+
+	checkMustGatherStreams(t, ingestTestArchive(t, server.URL+"/must-gather.zip"))
+}
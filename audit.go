@@ -1,94 +1,343 @@
 package main
 
 import (
-	"compress/gzip"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"sync"
+	"time"
 
-	"github.com/afiskon/promtail-client/promtail"
 	"github.com/simonfrey/jsonl"
 	"github.com/sirupsen/logrus"
 	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
 )
 
-func parseAuditLogAndSendToOLTP(logger *logrus.Logger, path string, loki promtail.Client) error {
-	var errs []error
+const (
+	sinkBatchSize  = 1000
+	progressEvents = 100000
+
+	onParseErrorFail       = "fail"
+	onParseErrorSkip       = "skip"
+	onParseErrorQuarantine = "quarantine"
+	quarantineFileSuffix   = ".quarantine.jsonl"
+)
+
+// ParseConfig stores settings for audit log parsing
+type ParseConfig struct {
+	// What to do with malformed lines: fail, skip or quarantine
+	OnError string
+	// Directory for quarantine files, next to the parsed file if empty
+	QuarantineDir string
+	// Events outside of the window are dropped
+	Window timeWindow
+}
+
+// timeWindow is a time range, zero bounds are open
+type timeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Contains returns true if t is within the window
+func (w timeWindow) Contains(t time.Time) bool {
+	return (w.Start.IsZero() || !t.Before(w.Start)) && (w.End.IsZero() || !t.After(w.End))
+}
+
+// parseStats stores counters for a single audit log file
+type parseStats struct {
+	Found    int
+	Sent     int
+	BadLines int
+}
+
+// quarantinedLine is a malformed line written to quarantine file
+type quarantinedLine struct {
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+	Raw   string `json:"raw"`
+}
+
+func createQuarantineFile(conf ParseConfig, auditLogPath string) (*os.File, error) {
+	if len(conf.QuarantineDir) > 0 {
+		if err := os.MkdirAll(conf.QuarantineDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return os.Create(quarantinePath(conf, auditLogPath))
+}
+
+func validateParseConfig(conf ParseConfig) error {
+	switch conf.OnError {
+	case onParseErrorFail, onParseErrorSkip, onParseErrorQuarantine:
+		return nil
+	default:
+		return fmt.Errorf("invalid parse error mode %s, expected one of: %s, %s, %s", conf.OnError, onParseErrorFail, onParseErrorSkip, onParseErrorQuarantine)
+	}
+}
+
+// quarantinePath returns path of the sidecar file for malformed lines
+func quarantinePath(conf ParseConfig, auditLogPath string) string {
+	name := auditLogName(auditLogPath)
+	if len(conf.QuarantineDir) == 0 {
+		return name + quarantineFileSuffix
+	}
+	return filepath.Join(conf.QuarantineDir, filepath.Base(name)+quarantineFileSuffix)
+}
+
+// errorCollector gathers errors from several goroutines
+type errorCollector struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (c *errorCollector) Add(err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func (c *errorCollector) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return errors.Join(c.errs...)
+}
+
+// parsedEvent is an audit event along with the end offset of its line in decompressed data
+type parsedEvent struct {
+	auditapi.Event
+	Offset int64
+}
+
+// openFunc opens audit log for reading
+type openFunc func() (io.ReadCloser, error)
+
+// parseAuditLogAndSendToOLTP sends events from the audit log to the sink. If imp is set
+// already shipped events are skipped and progress is recorded in import state
+func parseAuditLogAndSendToOLTP(ctx context.Context, logger *logrus.Logger, path string, sink Sink, conf ParseConfig, imp *fileImport) (parseStats, error) {
+	return sendAuditLog(ctx, logger, path, func() (io.ReadCloser, error) { return openAuditLog(path) }, sink, conf, imp)
+}
+
+// sendAuditLog sends events from the audit log opened by open to the sink, path is used in logs
+func sendAuditLog(ctx context.Context, logger *logrus.Logger, path string, open openFunc, sink Sink, conf ParseConfig, imp *fileImport) (parseStats, error) {
+	var (
+		errs     errorCollector
+		wg       sync.WaitGroup
+		badLines int
+	)
 	foundEvents := 0
 	sentEvents := 0
-	eventCh := make(chan auditapi.Event)
+	eventCh := make(chan parsedEvent, sinkBatchSize)
 
-	logger.WithFields(logrus.Fields{"path": path}).Info("Parsing audit log")
+	logger.WithFields(logrus.Fields{"path": auditLogName(path)}).Info("Parsing audit log")
 
+	wg.Add(1)
 	go func() {
-		err := parseAuditLog(path, eventCh, logger)
+		defer wg.Done()
+		defer close(eventCh)
+		var err error
+		badLines, err = parseAuditLog(ctx, path, open, eventCh, logger, conf, imp)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("Failed to parse %s: %v", path, err))
+			errs.Add(fmt.Errorf("failed to parse %s: %v", path, err))
 		}
 	}()
 
-	for event := range eventCh {
-		// Send to loki
-		err := sendEventToLoki(loki, event)
-		if err != nil {
-			errs = append(errs, err)
+	var (
+		last      parsedEvent
+		sinkFails int
+	)
+	batch := make([]auditapi.Event, 0, sinkBatchSize)
+	sendBatch := func() {
+		if err := sink.WriteBatch(batch); err != nil {
+			errs.Add(err)
+			sinkFails++
 		} else {
-			sentEvents++
+			sentEvents += len(batch)
+		}
+		batch = batch[:0]
+	}
+	// checkpoint flushes the sink and records progress if all events were shipped
+	checkpoint := func() {
+		if len(batch) > 0 {
+			sendBatch()
+		}
+		if err := sink.Flush(); err != nil {
+			errs.Add(err)
+			sinkFails++
+		}
+		if imp == nil || sinkFails > 0 || last.Offset == 0 {
+			return
+		}
+		if err := imp.Shipped(last.Offset, last.Event); err != nil {
+			errs.Add(fmt.Errorf("failed to save import state: %v", err))
+		}
+	}
+	for event := range eventCh {
+		batch = append(batch, event.Event)
+		last = event
+		if len(batch) >= sinkBatchSize {
+			sendBatch()
 		}
 		foundEvents++
+		if imp != nil && foundEvents%checkpointEvents == 0 {
+			checkpoint()
+		}
+		if foundEvents%progressEvents == 0 {
+			logger.WithFields(logrus.Fields{"path": path, "found": foundEvents, "sent": sentEvents, "acknowledged": sink.Acknowledged()}).Info("Parsing progress")
+		}
 	}
-	logger.WithFields(logrus.Fields{"found": foundEvents, "sent": sentEvents}).Info("Log events sent")
-	return errors.Join(errs...)
-}
+	// Parser goroutine has exited, so its errors are collected already
+	wg.Wait()
 
-func parseAuditLog(filepath string, eventCh chan<- auditapi.Event, logger *logrus.Logger) error {
-	defer close(eventCh)
+	checkpoint()
+	if imp != nil && errs.Err() == nil {
+		if err := imp.Finish(); err != nil {
+			errs.Add(fmt.Errorf("failed to save import state: %v", err))
+		}
+	}
+	logger.WithFields(logrus.Fields{"found": foundEvents, "sent": sentEvents, "bad": badLines, "acknowledged": sink.Acknowledged()}).Info("Log events sent")
+	stats := parseStats{
+		Found:    foundEvents,
+		Sent:     sentEvents,
+		BadLines: badLines,
+	}
+	return stats, errs.Err()
+}
 
-	file, err := os.Open(filepath)
+// parseAuditLog sends all events from audit log opened by open to the channel, the channel is not closed.
+// filepath names the log in messages and quarantine files. Events shipped previously according to imp are skipped.
+// Returns number of malformed lines which were skipped or quarantined
+func parseAuditLog(ctx context.Context, filepath string, open openFunc, eventCh chan<- parsedEvent, logger *logrus.Logger, conf ParseConfig, imp *fileImport) (int, error) {
+	reader, err := open()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer file.Close()
+	defer reader.Close()
 
-	// Attempt to read as gzip
-	var reader io.Reader
-	if path.Ext(filepath) == ".gz" {
-		fz, err := gzip.NewReader(file)
-		if err != nil {
-			return err
-		}
-		defer fz.Close()
-		reader = fz
-	} else {
-		reader = file
+	parser := newLineParser(logger, filepath, conf)
+	defer parser.Close()
+
+	resumeOffset := int64(0)
+	if imp != nil {
+		resumeOffset = imp.ResumeOffset()
+	}
+	if resumeOffset > 0 {
+		logger.WithFields(logrus.Fields{"path": filepath, "offset": resumeOffset}).Info("Resuming partially imported file")
 	}
 
-	lineNum := 0
+	var (
+		offset   int64
+		filtered int
+	)
 	r := jsonl.NewReader(reader)
 	err = r.ReadLines(func(data []byte) error {
-		lineNum++
-		var event auditapi.Event
-		if err := json.Unmarshal(data, &event); err != nil {
-			logger.WithFields(logrus.Fields{"error": err, "line": lineNum}).Error("Unable to unmarshal audit event")
+		offset += int64(len(data)) + 1
+		if offset < resumeOffset {
+			parser.SkipLine()
+			return nil
+		}
+		event, ok, err := parser.Parse(data)
+		if err != nil || !ok {
 			return err
 		}
-		eventCh <- event
-		return nil
+		if offset == resumeOffset {
+			if !imp.VerifyResume(event) {
+				return fmt.Errorf("line %d: event %s doesn't match last imported one, use --force to re-import the file", parser.lineNum, event.AuditID)
+			}
+			return nil
+		}
+		if !conf.Window.Contains(event.StageTimestamp.Time) {
+			filtered++
+			return nil
+		}
+		select {
+		case eventCh <- parsedEvent{Event: event, Offset: offset}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
+	if filtered > 0 {
+		logger.WithFields(logrus.Fields{"path": filepath, "dropped": filtered}).Info("Dropped events outside of time window")
+	}
 	if err != nil {
-		return err
+		return parser.BadLines(), err
 	}
-	return nil
+	return parser.BadLines(), nil
 }
 
-func sendEventToLoki(loki promtail.Client, event auditapi.Event) error {
-	eventJson, err := json.Marshal(event)
-	if err != nil {
-		return err
+// lineParser decodes audit log lines one by one, handling malformed lines according to parse config
+type lineParser struct {
+	logger     *logrus.Logger
+	path       string
+	conf       ParseConfig
+	quarantine *os.File
+	lineNum    int
+	badLines   int
+}
+
+func newLineParser(logger *logrus.Logger, path string, conf ParseConfig) *lineParser {
+	return &lineParser{
+		logger: logger,
+		path:   path,
+		conf:   conf,
+	}
+}
+
+// Parse decodes next line. Returns false if the line was malformed and skipped
+func (p *lineParser) Parse(data []byte) (auditapi.Event, bool, error) {
+	p.lineNum++
+	event, err := decodeAuditEvent(data)
+	if err == nil {
+		return event, true, nil
+	}
+
+	switch p.conf.OnError {
+	case onParseErrorSkip:
+		p.badLines++
+		p.logger.WithFields(logrus.Fields{"error": err, "path": p.path, "line": p.lineNum}).Warning("Skipping malformed audit event")
+		return event, false, nil
+	case onParseErrorQuarantine:
+		p.badLines++
+		if p.quarantine == nil {
+			quarantine, qErr := createQuarantineFile(p.conf, p.path)
+			if qErr != nil {
+				return event, false, qErr
+			}
+			p.quarantine = quarantine
+		}
+		p.logger.WithFields(logrus.Fields{"error": err, "path": p.path, "line": p.lineNum, "quarantine": p.quarantine.Name()}).Warning("Quarantining malformed audit event")
+		return event, false, jsonl.NewWriter(p.quarantine).Write(quarantinedLine{
+			File:  p.path,
+			Line:  p.lineNum,
+			Error: err.Error(),
+			Raw:   string(data),
+		})
+	default:
+		p.logger.WithFields(logrus.Fields{"error": err, "line": p.lineNum}).Error("Unable to unmarshal audit event")
+		return event, false, fmt.Errorf("line %d: %v", p.lineNum, err)
+	}
+}
+
+// SkipLine advances line counter without parsing the line
+func (p *lineParser) SkipLine() {
+	p.lineNum++
+}
+
+// BadLines returns number of skipped or quarantined lines
+func (p *lineParser) BadLines() int {
+	return p.badLines
+}
+
+func (p *lineParser) Close() error {
+	if p.quarantine == nil {
+		return nil
 	}
-	loki.JSON(event.StageTimestamp.Time, string(eventJson))
-	return nil
+	return p.quarantine.Close()
 }
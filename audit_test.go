@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// failingSink rejects all batches
+type failingSink struct {
+	memorySink
+}
+
+func (s *failingSink) WriteBatch(events []auditapi.Event) error {
+	return errors.New("backend unavailable")
+}
+
+func TestParseAuditLogMalformedLine(t *testing.T) {
+	lines := strings.SplitAfter(testAuditLog, "\n")
+	path := writeTestAuditLog(t, lines[0]+`{"kind":"Event","auditID":`+"\n"+lines[1])
+	sink := &memorySink{}
+
+	_, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, sink, failOnParseError, nil)
+	if err == nil {
+		t.Fatal("expected parse error for malformed line")
+	}
+	if !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error to mention line 2, got: %v", err)
+	}
+	if len(sink.events) != 1 || sink.events[0].AuditID != "a1" {
+		t.Errorf("expected events before malformed line to be sent, got %d events", len(sink.events))
+	}
+}
+
+func TestParseAuditLogSkipMalformedLines(t *testing.T) {
+	lines := strings.SplitAfter(testAuditLog, "\n")
+	path := writeTestAuditLog(t, lines[0]+"not json\n"+lines[1]+`{"kind":"Event","audit`)
+	sink := &memorySink{}
+
+	stats, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, sink, ParseConfig{OnError: onParseErrorSkip}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.BadLines != 2 {
+		t.Errorf("expected 2 bad lines, got %d", stats.BadLines)
+	}
+	if len(sink.events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(sink.events))
+	}
+}
+
+func TestParseAuditLogQuarantineMalformedLines(t *testing.T) {
+	lines := strings.SplitAfter(testAuditLog, "\n")
+	path := writeTestAuditLog(t, lines[0]+"not json\n"+lines[1])
+	conf := ParseConfig{OnError: onParseErrorQuarantine, QuarantineDir: t.TempDir()}
+
+	stats, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, &memorySink{}, conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.BadLines != 1 {
+		t.Errorf("expected 1 bad line, got %d", stats.BadLines)
+	}
+
+	data, err := os.ReadFile(quarantinePath(conf, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var quarantined quarantinedLine
+	if err := json.Unmarshal(data, &quarantined); err != nil {
+		t.Fatal(err)
+	}
+	if quarantined.Line != 2 || quarantined.Raw != "not json" || quarantined.File != path {
+		t.Errorf("unexpected quarantined line: %+v", quarantined)
+	}
+}
+
+func TestParseAuditLogMissingFile(t *testing.T) {
+	sink := &memorySink{}
+	_, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), "/nonexistent/audit.log", sink, failOnParseError, nil)
+	if err == nil {
+		t.Fatal("expected error for missing file")
+	}
+	if sink.flushes != 1 {
+		t.Errorf("expected sink to be flushed once, got %d", sink.flushes)
+	}
+}
+
+func TestParseAuditLogSinkErrors(t *testing.T) {
+	path := writeTestAuditLog(t, testAuditLog)
+	sink := &failingSink{}
+
+	_, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, sink, failOnParseError, nil)
+	if err == nil || !strings.Contains(err.Error(), "backend unavailable") {
+		t.Fatalf("expected sink error to be returned, got: %v", err)
+	}
+}
+
+func TestDecodeAuditEventV1beta1(t *testing.T) {
+	line := `{"kind":"Event","apiVersion":"audit.k8s.io/v1beta1","metadata":{"creationTimestamp":"2024-09-16T10:00:00Z"},"level":"Metadata","timestamp":"2024-09-16T10:00:00Z","auditID":"b1","stage":"ResponseComplete","requestURI":"/api/v1/pods","verb":"list","user":{"username":"system:admin"}}`
+	event, err := decodeAuditEvent([]byte(line))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.APIVersion != auditapi.SchemeGroupVersion.String() {
+		t.Errorf("expected event to be converted to v1, got %s", event.APIVersion)
+	}
+	if event.StageTimestamp.IsZero() || event.RequestReceivedTimestamp.IsZero() {
+		t.Errorf("expected timestamps to be set from v1beta1 timestamp, got %v and %v", event.RequestReceivedTimestamp, event.StageTimestamp)
+	}
+	if event.StageTimestamp.Unix() != 1726480800 {
+		t.Errorf("unexpected stage timestamp %v", event.StageTimestamp)
+	}
+}
+
+func TestDecodeAuditEventUnsupported(t *testing.T) {
+	for _, line := range []string{
+		`{"kind":"Policy","apiVersion":"audit.k8s.io/v1"}`,
+		`{"kind":"Event","apiVersion":"audit.k8s.io/v1alpha1"}`,
+	} {
+		if _, err := decodeAuditEvent([]byte(line)); err == nil {
+			t.Errorf("expected error for %s", line)
+		}
+	}
+}
+
+func TestParseAuditLogDropsEventsOutsideWindow(t *testing.T) {
+	path := writeTestAuditLog(t, testAuditLog)
+	sink := &memorySink{}
+	conf := ParseConfig{
+		OnError: onParseErrorFail,
+		Window: timeWindow{
+			Start: time.Date(2024, 9, 16, 10, 0, 1, 0, time.UTC),
+		},
+	}
+	if _, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, sink, conf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 1 || sink.events[0].AuditID != "a2" {
+		t.Errorf("expected only a2 to be sent, got %d events", len(sink.events))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	auditEventKind    = "Event"
+	auditV1beta1Group = "audit.k8s.io/v1beta1"
+)
+
+// auditEventAnyVersion is a superset of audit.k8s.io/v1 and audit.k8s.io/v1beta1 events.
+// v1beta1 is no longer shipped in k8s.io/apiserver, so its conversion is done here
+type auditEventAnyVersion struct {
+	auditapi.Event
+	// Time the request reached the apiserver, set in v1beta1 events only
+	Timestamp metav1.Time `json:"timestamp"`
+}
+
+// decodeAuditEvent decodes audit event of any supported version and converts it to audit.k8s.io/v1
+func decodeAuditEvent(data []byte) (auditapi.Event, error) {
+	var event auditEventAnyVersion
+	if err := json.Unmarshal(data, &event); err != nil {
+		return auditapi.Event{}, err
+	}
+	if len(event.Kind) > 0 && event.Kind != auditEventKind {
+		return auditapi.Event{}, fmt.Errorf("unsupported kind %s, expected %s", event.Kind, auditEventKind)
+	}
+
+	switch event.APIVersion {
+	case auditapi.SchemeGroupVersion.String(), "":
+		// Old logs may have no type info, assume these are v1
+		return event.Event, nil
+	case auditV1beta1Group:
+		return convertV1beta1Event(event), nil
+	default:
+		return auditapi.Event{}, fmt.Errorf("unsupported apiVersion %s, expected %s or %s", event.APIVersion, auditapi.SchemeGroupVersion.String(), auditV1beta1Group)
+	}
+}
+
+// convertV1beta1Event converts v1beta1 event to v1. Early v1beta1 events have no
+// requestReceivedTimestamp and stageTimestamp, deprecated timestamp field is used instead
+func convertV1beta1Event(event auditEventAnyVersion) auditapi.Event {
+	result := event.Event
+	result.APIVersion = auditapi.SchemeGroupVersion.String()
+	if result.RequestReceivedTimestamp.IsZero() && !event.Timestamp.IsZero() {
+		result.RequestReceivedTimestamp = metav1.NewMicroTime(event.Timestamp.Time)
+	}
+	if result.StageTimestamp.IsZero() {
+		result.StageTimestamp = result.RequestReceivedTimestamp
+	}
+	return result
+}
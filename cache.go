@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/melbahja/got"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	downloadCacheDirName = "downloads"
+	cacheIndexFileName   = "index.json"
+	cacheFileSuffix      = ".cache"
+	defaultCacheMaxSize  = 10 * 1024 // MB
+	cachePermissions     = 0755
+)
+
+// cacheEntry describes downloaded artifact stored in the cache
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	File         string    `json:"file"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Size         int64     `json:"size"`
+	LastUsed     time.Time `json:"lastUsed"`
+}
+
+// downloadCache stores downloaded artifacts keyed by URL, validating them with ETag and Last-Modified.
+// Least recently used artifacts are evicted once cache size exceeds the limit
+type downloadCache struct {
+	logger    *logrus.Logger
+	dir       string
+	maxSize   int64
+	netClient *http.Client
+	// streamed artifacts are cached while they are read, otherwise only downloaded artifacts are cached
+	streamed bool
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func defaultDownloadCacheDir() string {
+	return filepath.Join(defaultCacheDir(), downloadCacheDirName)
+}
+
+// openDownloadCache reads cache index, missing index is treated as empty cache.
+// maxSize is in bytes, 0 disables eviction
+func openDownloadCache(logger *logrus.Logger, dir string, maxSize int64) (*downloadCache, error) {
+	c := &downloadCache{
+		logger:  logger,
+		dir:     dir,
+		maxSize: maxSize,
+		netClient: &http.Client{
+			Timeout: httpTimeout,
+		},
+		entries: map[string]cacheEntry{},
+	}
+	data, err := os.ReadFile(filepath.Join(dir, cacheIndexFileName))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse cache index in %s: %v", dir, err)
+	}
+	return c, nil
+}
+
+// Fetch returns path to the cached copy of the artifact, downloading it if it's missing or changed
+func (c *downloadCache) Fetch(artifactURL string) (string, error) {
+	cachedPath, entry, err := c.lookup(artifactURL)
+	if err != nil || len(cachedPath) > 0 {
+		return cachedPath, err
+	}
+	if err := os.MkdirAll(c.dir, cachePermissions); err != nil {
+		return "", err
+	}
+	// Download to temp file so that interrupted download is never used
+	tmpPath := entry.path(c.dir) + ".tmp"
+	c.logger.WithFields(logrus.Fields{"url": artifactURL, "path": entry.path(c.dir)}).Info("Downloading to cache")
+	if err := got.New().Download(artifactURL, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return c.add(entry, tmpPath)
+}
+
+// Open returns cached copy of the artifact if it's unchanged. Otherwise the artifact is streamed from the URL
+// and written to the cache as it's read, it's added to the cache once it's read to the end
+func (c *downloadCache) Open(ctx context.Context, artifactURL string) (io.ReadCloser, error) {
+	cachedPath, entry, err := c.lookup(artifactURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(cachedPath) > 0 {
+		return os.Open(cachedPath)
+	}
+	if err := os.MkdirAll(c.dir, cachePermissions); err != nil {
+		return nil, err
+	}
+	body, err := fetchArtifact(ctx, artifactURL)
+	if err != nil {
+		return nil, err
+	}
+	// Concurrent streams of the artifact write to their own temp files
+	tmp, err := os.CreateTemp(c.dir, entry.File+"-*.tmp")
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	c.logger.WithFields(logrus.Fields{"url": artifactURL, "path": entry.path(c.dir)}).Info("Streaming to cache")
+	return &cachingReader{cache: c, entry: entry, body: body, tmp: tmp}, nil
+}
+
+// lookup returns path to the cached copy of the artifact if it can be used. Otherwise it returns
+// the entry the artifact should be downloaded to
+func (c *downloadCache) lookup(artifactURL string) (string, cacheEntry, error) {
+	etag, lastModified, err := c.validators(artifactURL)
+	c.mu.Lock()
+	entry, ok := c.entries[artifactURL]
+	c.mu.Unlock()
+	if ok {
+		_, statErr := os.Stat(entry.path(c.dir))
+		switch {
+		case statErr != nil:
+			c.logger.WithFields(logrus.Fields{"url": artifactURL}).Info("Cached file is missing, downloading")
+		case err != nil:
+			// Use cached copy if artifact can't be validated, e.g. when offline
+			c.logger.WithFields(logrus.Fields{"url": artifactURL, "error": err}).Warning("Failed to validate cached file, using it anyway")
+			return entry.path(c.dir), entry, c.touch(artifactURL)
+		case entry.matches(etag, lastModified):
+			c.logger.WithFields(logrus.Fields{"url": artifactURL, "path": entry.path(c.dir)}).Info("Using cached file")
+			return entry.path(c.dir), entry, c.touch(artifactURL)
+		default:
+			c.logger.WithFields(logrus.Fields{"url": artifactURL}).Info("Cached file has changed, downloading")
+		}
+	} else if err != nil {
+		return "", entry, err
+	}
+	return "", cacheEntry{
+		URL:          artifactURL,
+		File:         cacheFileName(artifactURL),
+		ETag:         etag,
+		LastModified: lastModified,
+	}, nil
+}
+
+// add moves downloaded temp file to the cache and evicts least recently used artifacts
+func (c *downloadCache) add(entry cacheEntry, tmpPath string) (string, error) {
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, entry.path(c.dir)); err != nil {
+		return "", err
+	}
+	entry.Size = info.Size()
+	entry.LastUsed = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[entry.URL] = entry
+	// Artifact being used must not be evicted
+	if err := c.evict(c.maxSize, entry.URL); err != nil {
+		return "", err
+	}
+	return entry.path(c.dir), c.save()
+}
+
+// cachingReader writes streamed artifact to a temp file, which is added to the cache on close
+// if the artifact was read to the end
+type cachingReader struct {
+	cache    *downloadCache
+	entry    cacheEntry
+	body     io.ReadCloser
+	tmp      *os.File
+	writeErr error
+	complete bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.writeErr == nil {
+		_, r.writeErr = r.tmp.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	// Archive readers stop at the end of the archive, padding after it is still cached. Cancelled
+	// request fails here, so the artifact isn't downloaded on shutdown
+	if !r.complete && r.writeErr == nil {
+		io.Copy(io.Discard, r)
+	}
+	r.body.Close()
+	if err := r.tmp.Close(); err != nil && r.writeErr == nil {
+		r.writeErr = err
+	}
+	if !r.complete || r.writeErr != nil {
+		os.Remove(r.tmp.Name())
+		if r.writeErr != nil {
+			return fmt.Errorf("failed to cache %s: %v", r.entry.URL, r.writeErr)
+		}
+		return nil
+	}
+	_, err := r.cache.add(r.entry, r.tmp.Name())
+	return err
+}
+
+// validators returns ETag and Last-Modified of the artifact
+func (c *downloadCache) validators(artifactURL string) (string, string, error) {
+	resp, err := c.netClient.Head(artifactURL)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch %s: %v", artifactURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("failed to check %s: returned %s", artifactURL, resp.Status)
+	}
+	return resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+func (c *downloadCache) touch(artifactURL string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[artifactURL]
+	entry.LastUsed = time.Now()
+	c.entries[artifactURL] = entry
+	return c.save()
+}
+
+// Entries returns cached artifacts, most recently used first
+func (c *downloadCache) Entries() []cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]cacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastUsed.After(result[j].LastUsed) })
+	return result
+}
+
+// Prune evicts least recently used artifacts until cache size is not above maxSize
+func (c *downloadCache) Prune(maxSize int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.evict(maxSize, ""); err != nil {
+		return err
+	}
+	return c.save()
+}
+
+// evict removes least recently used entries except keep until total size fits maxSize,
+// must be called with the lock held
+func (c *downloadCache) evict(maxSize int64, keep string) error {
+	// Zero limit disables eviction on download, but prunes everything when pruning explicitly
+	if maxSize <= 0 && len(keep) > 0 {
+		return nil
+	}
+	entries := make([]cacheEntry, 0, len(c.entries))
+	total := int64(0)
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+		total += entry.Size
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.Before(entries[j].LastUsed) })
+
+	var errs []error
+	for _, entry := range entries {
+		if total <= maxSize {
+			break
+		}
+		if entry.URL == keep {
+			continue
+		}
+		if err := os.Remove(entry.path(c.dir)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		delete(c.entries, entry.URL)
+		total -= entry.Size
+		c.logger.WithFields(logrus.Fields{"url": entry.URL, "size": entry.Size}).Info("Evicted cached file")
+	}
+	return errors.Join(errs...)
+}
+
+// save writes cache index, must be called with the lock held
+func (c *downloadCache) save() error {
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, cachePermissions); err != nil {
+		return err
+	}
+	indexPath := filepath.Join(c.dir, cacheIndexFileName)
+	tmp := indexPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, indexPath)
+}
+
+func (e cacheEntry) path(dir string) string {
+	return filepath.Join(dir, e.File)
+}
+
+// matches returns true if cached copy has the same validators as the remote artifact.
+// Artifacts without validators are never considered changed
+func (e cacheEntry) matches(etag, lastModified string) bool {
+	if len(etag) > 0 || len(e.ETag) > 0 {
+		return etag == e.ETag
+	}
+	return lastModified == e.LastModified
+}
+
+func cacheFileName(artifactURL string) string {
+	hash := sha256.Sum256([]byte(artifactURL))
+	return hex.EncodeToString(hash[:]) + cacheFileSuffix
+}
+
+// runCache lists or prunes download cache
+func runCache(args []string) {
+	var (
+		cacheDir string
+		maxSize  int64
+		all      bool
+	)
+	logger := setupLogger()
+
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	fs.StringVar(&cacheDir, "cache-dir", defaultDownloadCacheDir(), "directory storing downloaded artifacts")
+	fs.Int64Var(&maxSize, "max-size", defaultCacheMaxSize, "prune: cache size limit in MB")
+	fs.BoolVar(&all, "all", false, "prune: remove all cached files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cache ls|prune [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+
+	cache, err := openDownloadCache(logger, cacheDir, maxSize*1024*1024)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	switch command {
+	case "ls":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SIZE\tLAST USED\tURL")
+		total := int64(0)
+		for _, entry := range cache.Entries() {
+			fmt.Fprintf(w, "%.1fM\t%s\t%s\n", float64(entry.Size)/1024/1024, entry.LastUsed.Format(time.RFC3339), entry.URL)
+			total += entry.Size
+		}
+		w.Flush()
+		fmt.Printf("Total: %.1fM in %s\n", float64(total)/1024/1024, cacheDir)
+	case "prune":
+		limit := maxSize * 1024 * 1024
+		if all {
+			limit = 0
+		}
+		if err := cache.Prune(limit); err != nil {
+			logger.Fatal(err)
+		}
+		logger.WithFields(logrus.Fields{"dir": cacheDir, "files": len(cache.Entries())}).Info("Cache pruned")
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testArtifactServer serves artifacts with ETag and counts GET requests
+type testArtifactServer struct {
+	mu      sync.Mutex
+	content map[string]string
+	etags   map[string]string
+	gets    int
+}
+
+func (s *testArtifactServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, ok := s.content[r.URL.Path]
+	etag := s.etags[r.URL.Path]
+	if r.Method == http.MethodGet {
+		s.gets++
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte(content)))
+}
+
+func (s *testArtifactServer) Gets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func TestDownloadCache(t *testing.T) {
+	artifacts := &testArtifactServer{
+		content: map[string]string{"/a.tar": "first artifact", "/b.tar": "second artifact"},
+		etags:   map[string]string{"/a.tar": `"1"`, "/b.tar": `"1"`},
+	}
+	server := httptest.NewServer(artifacts)
+	defer server.Close()
+
+	dir := t.TempDir()
+	cache, err := openDownloadCache(testLogger(), dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(name, expected string) string {
+		t.Helper()
+		path, err := cache.Fetch(server.URL + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %q, got %q", expected, data)
+		}
+		return path
+	}
+
+	fetch("/a.tar", "first artifact")
+	gets := artifacts.Gets()
+
+	// Cache index is persisted, unchanged artifact is not downloaded again
+	cache, err = openDownloadCache(testLogger(), dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch("/a.tar", "first artifact")
+	if artifacts.Gets() != gets {
+		t.Errorf("expected cached artifact to be used")
+	}
+
+	// Changed artifact is downloaded again
+	artifacts.mu.Lock()
+	artifacts.content["/a.tar"] = "updated artifact"
+	artifacts.etags["/a.tar"] = `"2"`
+	artifacts.mu.Unlock()
+	aPath := fetch("/a.tar", "updated artifact")
+
+	// Both artifacts don't fit, least recently used one is evicted
+	fetch("/b.tar", "second artifact")
+	if _, err := os.Stat(aPath); !os.IsNotExist(err) {
+		t.Errorf("expected least recently used artifact to be evicted")
+	}
+	if entries := cache.Entries(); len(entries) != 1 || entries[0].URL != server.URL+"/b.tar" {
+		t.Errorf("unexpected cache entries %v", entries)
+	}
+
+	if err := cache.Prune(0); err != nil {
+		t.Fatal(err)
+	}
+	if entries := cache.Entries(); len(entries) != 0 {
+		t.Errorf("expected empty cache after pruning, got %v", entries)
+	}
+}
+
+func TestOpenArtifact(t *testing.T) {
+	artifacts := &testArtifactServer{
+		content: map[string]string{"/a.tar": "streamed artifact"},
+		etags:   map[string]string{"/a.tar": `"1"`},
+	}
+	server := httptest.NewServer(artifacts)
+	defer server.Close()
+	cache, err := openDownloadCache(testLogger(), t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(readAll bool) {
+		t.Helper()
+		body, err := openArtifact(context.Background(), cache, server.URL+"/a.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readAll {
+			data, err := io.ReadAll(body)
+			if err != nil || string(data) != "streamed artifact" {
+				t.Fatalf("expected streamed artifact, got %q: %v", data, err)
+			}
+		}
+		if err := body.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Streamed artifacts are not cached by default
+	read(true)
+	if entries := cache.Entries(); len(entries) != 0 {
+		t.Errorf("expected streamed artifact not to be cached, got %v", entries)
+	}
+
+	cache.streamed = true
+	read(true)
+	entries := cache.Entries()
+	if len(entries) != 1 || entries[0].Size != int64(len("streamed artifact")) {
+		t.Fatalf("expected streamed artifact to be cached, got %v", entries)
+	}
+	gets := artifacts.Gets()
+	read(true)
+	if artifacts.Gets() != gets {
+		t.Errorf("expected cached copy to be used")
+	}
+
+	// Artifact which was not read to the end is downloaded on close
+	if err := cache.Prune(0); err != nil {
+		t.Fatal(err)
+	}
+	read(false)
+	if entries := cache.Entries(); len(entries) != 1 {
+		t.Errorf("expected artifact to be cached once closed, got %v", entries)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(cache.dir, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("expected no temp files left, got %v", tmp)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	aggregationCount = "count"
+	aggregationP50   = "p50_ms"
+	aggregationP90   = "p90_ms"
+	aggregationP99   = "p99_ms"
+	aggregationMax   = "max_ms"
+
+	groupByUser      = "user"
+	groupByVerb      = "verb"
+	groupByResource  = "resource"
+	groupByNamespace = "namespace"
+
+	junitSuiteName = "audit-span check"
+	// junitStdoutPath is used instead of file path to write JUnit XML to stdout
+	junitStdoutPath = "-"
+	// maxJUnitViolations limits violations listed in a failed test case, Prow shows the whole failure text
+	maxJUnitViolations = 20
+)
+
+// aggregationQuantiles maps latency aggregations to quantiles of request duration
+var aggregationQuantiles = map[string]float64{
+	aggregationP50: 0.5,
+	aggregationP90: 0.9,
+	aggregationP99: 0.99,
+	aggregationMax: 1,
+}
+
+// groupByKeys extract values of a request which rules are grouped by
+var groupByKeys = map[string]func(eventRecord) string{
+	groupByUser:      eventUsername,
+	groupByVerb:      eventVerb,
+	groupByResource:  eventResource,
+	groupByNamespace: eventNamespace,
+}
+
+// checkRules is the YAML rule file of check command
+type checkRules struct {
+	Rules []*checkRule `yaml:"rules"`
+}
+
+// checkRule fails if aggregated value of selected requests exceeds threshold in any group and window
+type checkRule struct {
+	Name        string       `yaml:"name"`
+	Description string       `yaml:"description"`
+	Selector    ruleSelector `yaml:"selector"`
+	// GroupBy lists user, verb, resource or namespace, requests are aggregated over all selected ones if empty
+	GroupBy []string `yaml:"groupBy"`
+	// Aggregation is count of requests or a quantile of their duration, count if empty
+	Aggregation string `yaml:"aggregation"`
+	// Window is a Go duration of windows aligned to its multiple, the whole dataset if empty
+	Window    string  `yaml:"window"`
+	Threshold float64 `yaml:"threshold"`
+
+	window time.Duration
+}
+
+// ruleSelector matches completed requests, all set fields must match. Lists match if any glob matches
+type ruleSelector struct {
+	Users []string `yaml:"users"`
+	Verbs []string `yaml:"verbs"`
+	// Resources globs are matched against resource, resource/subresource and group/version/resource
+	Resources  []string `yaml:"resources"`
+	Namespaces []string `yaml:"namespaces"`
+	// Annotations maps annotation keys to globs of their values
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// loadCheckRules reads and validates YAML rule file
+func loadCheckRules(path string) (*checkRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules %s: %v", path, err)
+	}
+	rules := &checkRules{}
+	if err := yaml.UnmarshalStrict(data, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %v", path, err)
+	}
+	if err := rules.validate(); err != nil {
+		return nil, fmt.Errorf("invalid rules %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+func (r *checkRules) validate() error {
+	if len(r.Rules) == 0 {
+		return errors.New("no rules defined")
+	}
+	names := map[string]bool{}
+	var errs []error
+	for i, rule := range r.Rules {
+		if len(rule.Name) == 0 {
+			errs = append(errs, fmt.Errorf("rule %d has no name", i))
+			continue
+		}
+		if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("rule %s is defined twice", rule.Name))
+		}
+		names[rule.Name] = true
+		if err := rule.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %v", rule.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *checkRule) validate() error {
+	if len(r.Aggregation) == 0 {
+		r.Aggregation = aggregationCount
+	}
+	if _, ok := aggregationQuantiles[r.Aggregation]; !ok && r.Aggregation != aggregationCount {
+		return fmt.Errorf("unknown aggregation %s, expected %s, %s, %s, %s or %s", r.Aggregation, aggregationCount, aggregationP50, aggregationP90, aggregationP99, aggregationMax)
+	}
+	for _, groupBy := range r.GroupBy {
+		if _, ok := groupByKeys[groupBy]; !ok {
+			return fmt.Errorf("unknown groupBy %s, expected %s, %s, %s or %s", groupBy, groupByUser, groupByVerb, groupByResource, groupByNamespace)
+		}
+	}
+	if len(r.Window) > 0 {
+		window, err := time.ParseDuration(r.Window)
+		if err != nil {
+			return fmt.Errorf("invalid window: %v", err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("window must be positive, got %s", r.Window)
+		}
+		r.window = window
+	}
+	if r.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative, got %v", r.Threshold)
+	}
+	patterns := slices.Concat(r.Selector.Users, r.Selector.Verbs, r.Selector.Resources, r.Selector.Namespaces)
+	for _, pattern := range r.Selector.Annotations {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid selector glob %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the request is selected by the rule
+func (s ruleSelector) Matches(e eventRecord) bool {
+	if !matchesAny(s.Users, eventUsername(e)) || !matchesAny(s.Verbs, eventVerb(e)) || !matchesAny(s.Namespaces, eventNamespace(e)) {
+		return false
+	}
+	if len(s.Resources) > 0 {
+		if e.ObjectRef == nil {
+			return false
+		}
+		resources := []string{e.ObjectRef.Resource, eventResource(e)}
+		if len(e.ObjectRef.Subresource) > 0 {
+			resources = append(resources, e.ObjectRef.Resource+"/"+e.ObjectRef.Subresource)
+		}
+		matched := false
+		for _, resource := range resources {
+			matched = matched || matchesAny(s.Resources, resource)
+		}
+		if !matched {
+			return false
+		}
+	}
+	for key, pattern := range s.Annotations {
+		value, ok := e.Annotations[key]
+		if !ok || !matchesAny([]string{pattern}, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether value matches any of the globs, empty list matches everything
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleGroup identifies requests aggregated together
+type ruleGroup struct {
+	Key    string
+	Window time.Time
+}
+
+// ruleBucket aggregates requests of a group
+type ruleBucket struct {
+	count  uint64
+	sketch *quantileSketch
+}
+
+// ruleChecker evaluates rules over completed requests, it's safe for concurrent use
+type ruleChecker struct {
+	mu      sync.Mutex
+	rules   []*checkRule
+	buckets []map[ruleGroup]*ruleBucket
+	matched []uint64
+}
+
+func newRuleChecker(rules *checkRules) *ruleChecker {
+	c := &ruleChecker{
+		rules:   rules.Rules,
+		buckets: make([]map[ruleGroup]*ruleBucket, len(rules.Rules)),
+		matched: make([]uint64, len(rules.Rules)),
+	}
+	for i := range c.buckets {
+		c.buckets[i] = map[ruleGroup]*ruleBucket{}
+	}
+	return c
+}
+
+// Add aggregates completed requests selected by each rule, events added by audit-span are skipped
+func (c *ruleChecker) Add(events []auditapi.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, event := range events {
+		if _, ok := event.Annotations[annotationTypeKey]; ok || event.Stage != auditapi.StageResponseComplete {
+			continue
+		}
+		record := newEventRecord(event)
+		for i, rule := range c.rules {
+			if !rule.Selector.Matches(record) {
+				continue
+			}
+			_, latency := aggregationQuantiles[rule.Aggregation]
+			if latency && record.DurationMS == nil {
+				continue
+			}
+			c.matched[i]++
+			group := ruleGroup{Key: ruleGroupKey(rule, record)}
+			if rule.window > 0 {
+				group.Window = event.RequestReceivedTimestamp.Time.Truncate(rule.window).UTC()
+			}
+			bucket, ok := c.buckets[i][group]
+			if !ok {
+				bucket = &ruleBucket{}
+				if latency {
+					bucket.sketch = newQuantileSketch()
+				}
+				c.buckets[i][group] = bucket
+			}
+			bucket.count++
+			if latency {
+				bucket.sketch.Add(*record.DurationMS)
+			}
+		}
+	}
+}
+
+func ruleGroupKey(rule *checkRule, e eventRecord) string {
+	parts := make([]string, 0, len(rule.GroupBy))
+	for _, groupBy := range rule.GroupBy {
+		parts = append(parts, groupBy+"="+groupByKeys[groupBy](e))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ruleViolation is a group and window where aggregated value exceeded rule threshold
+type ruleViolation struct {
+	Key    string
+	Window time.Time
+	Value  float64
+}
+
+// ruleResult is the outcome of a rule, it passed if there are no violations
+type ruleResult struct {
+	Rule       *checkRule
+	Matched    uint64
+	Violations []ruleViolation
+}
+
+// Results evaluates rules in the order of rule file, violations are sorted by value
+func (c *ruleChecker) Results() []ruleResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make([]ruleResult, 0, len(c.rules))
+	for i, rule := range c.rules {
+		result := ruleResult{Rule: rule, Matched: c.matched[i]}
+		for group, bucket := range c.buckets[i] {
+			value := float64(bucket.count)
+			if bucket.sketch != nil {
+				value = bucket.sketch.Quantile(aggregationQuantiles[rule.Aggregation])
+			}
+			if value > rule.Threshold {
+				result.Violations = append(result.Violations, ruleViolation{Key: group.Key, Window: group.Window, Value: value})
+			}
+		}
+		sort.Slice(result.Violations, func(i, j int) bool {
+			a, b := result.Violations[i], result.Violations[j]
+			if a.Value != b.Value {
+				return a.Value > b.Value
+			}
+			if a.Key != b.Key {
+				return a.Key < b.Key
+			}
+			return a.Window.Before(b.Window)
+		})
+		results = append(results, result)
+	}
+	return results
+}
+
+// String describes the violation, e.g. "user=alice in 2024-01-02T03:00:00Z/1h0m0s: count 510 > 500"
+func (v ruleViolation) String(rule *checkRule) string {
+	var b strings.Builder
+	if len(v.Key) > 0 {
+		b.WriteString(v.Key)
+	} else {
+		b.WriteString("all requests")
+	}
+	if !v.Window.IsZero() {
+		fmt.Fprintf(&b, " in %s/%s", v.Window.Format(time.RFC3339), rule.window)
+	}
+	fmt.Fprintf(&b, ": %s %s > %s", rule.Aggregation, formatRuleValue(v.Value), formatRuleValue(rule.Threshold))
+	return b.String()
+}
+
+func formatRuleValue(value float64) string {
+	return fmt.Sprintf("%.6g", value)
+}
+
+// junitTestSuites is JUnit XML document understood by Prow
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit prints rule results as JUnit test cases, one per rule
+func writeJUnit(w io.Writer, results []ruleResult) error {
+	suite := junitTestSuite{Name: junitSuiteName, Tests: len(results)}
+	for _, result := range results {
+		testCase := junitTestCase{
+			Name:      result.Rule.Name,
+			ClassName: junitSuiteName,
+			SystemOut: fmt.Sprintf("%d requests matched", result.Matched),
+		}
+		if len(result.Violations) > 0 {
+			suite.Failures++
+			lines := []string{}
+			if len(result.Rule.Description) > 0 {
+				lines = append(lines, result.Rule.Description)
+			}
+			for i, violation := range result.Violations {
+				if i == maxJUnitViolations {
+					lines = append(lines, fmt.Sprintf("... and %d more", len(result.Violations)-i))
+					break
+				}
+				lines = append(lines, violation.String(result.Rule))
+			}
+			testCase.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d violations of %s threshold %s", len(result.Violations), result.Rule.Aggregation, formatRuleValue(result.Rule.Threshold)),
+				Text:    strings.Join(lines, "\n"),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeJUnitFile writes JUnit XML to stdout or atomically to the file
+func writeJUnitFile(path string, results []ruleResult) error {
+	if path == junitStdoutPath {
+		return writeJUnit(os.Stdout, results)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmp, err)
+	}
+	if err := writeJUnit(f, results); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// runCheck evaluates rule file over audit logs, writes JUnit XML and exits with non-zero code if any rule failed
+func runCheck(args []string) {
+	var (
+		source    aggregateSource
+		rulesPath string
+		junitPath string
+	)
+	logger := setupLogger()
+
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.StringVar(&source.ProwJob, "prow-job", "", "prowjob URL")
+	fs.StringVar(&source.AuditLogDir, "audit-log-dir", "", "path to dir with audit logs, '-' to read from stdin")
+	fs.StringVar(&source.Input, "input", "", "path to audit log file or local or http(s) URL of tar, tar.gz or zip archive with audit logs, '-' to read from stdin")
+	aggregateOpts := addAggregateFlags(fs)
+	fs.StringVar(&rulesPath, "rules", "", "path to YAML rule file")
+	fs.StringVar(&junitPath, "junit", junitStdoutPath, "path to JUnit XML file written, '-' for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check --rules <file> --prow-job|--audit-log-dir|--input <source> [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(rulesPath) == 0 || (len(source.ProwJob) == 0 && len(source.AuditLogDir) == 0 && len(source.Input) == 0) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	rules, err := loadCheckRules(rulesPath)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	conf, err := aggregateOpts.AggregateConfig(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	// Rules passing on audit logs which couldn't be read would hide violations
+	conf.Strict = true
+
+	ctx, stop := signalContext(logger)
+	defer stop()
+
+	checker := newRuleChecker(rules)
+	if _, err := aggregate(ctx, logger, checker, conf, source); err != nil {
+		logger.Fatal(err)
+	}
+	results := checker.Results()
+	if err := writeJUnitFile(junitPath, results); err != nil {
+		logger.Fatal(err)
+	}
+	failed := 0
+	for _, result := range results {
+		if len(result.Violations) == 0 {
+			continue
+		}
+		failed++
+		logger.WithFields(logrus.Fields{
+			"rule":       result.Rule.Name,
+			"violations": len(result.Violations),
+			"worst":      result.Violations[0].String(result.Rule),
+		}).Error("Rule failed")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+	logger.WithFields(logrus.Fields{"rules": len(results)}).Info("All rules passed")
+}
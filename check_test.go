@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const testCheckRules = `
+rules:
+- name: list-pods-budget
+  description: No user may list pods more than twice per hour
+  selector:
+    verbs: [list]
+    resources: [pods]
+  groupBy: [user]
+  window: 1h
+  threshold: 2
+- name: deprecated-apis
+  selector:
+    users: ["system:serviceaccount:openshift-*"]
+    annotations:
+      k8s.io/deprecated: "true"
+  groupBy: [user, resource]
+  threshold: 0
+- name: slow-requests
+  aggregation: p99_ms
+  threshold: 500
+`
+
+func writeTestRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func checkTestEvent(user, verb, resource string, received time.Time, annotations map[string]string) auditapi.Event {
+	return auditapi.Event{
+		Stage:                    auditapi.StageResponseComplete,
+		Verb:                     verb,
+		User:                     authnv1.UserInfo{Username: user},
+		ObjectRef:                &auditapi.ObjectReference{APIGroup: "apps", APIVersion: "v1", Resource: resource},
+		RequestReceivedTimestamp: metav1.NewMicroTime(received),
+		StageTimestamp:           metav1.NewMicroTime(received.Add(10 * time.Millisecond)),
+		Annotations:              annotations,
+	}
+}
+
+func TestRuleChecker(t *testing.T) {
+	rules, err := loadCheckRules(writeTestRules(t, testCheckRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := newRuleChecker(rules)
+	hour := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	deprecated := map[string]string{deprecatedAnnotation: "true"}
+	checker.Add([]auditapi.Event{
+		// Three lists in the first hour exceed the budget, two in the next one don't
+		checkTestEvent("alice", "list", "pods", hour.Add(time.Minute), nil),
+		checkTestEvent("alice", "list", "pods", hour.Add(2*time.Minute), nil),
+		checkTestEvent("alice", "list", "pods", hour.Add(59*time.Minute), nil),
+		checkTestEvent("alice", "list", "pods", hour.Add(61*time.Minute), nil),
+		checkTestEvent("alice", "list", "pods", hour.Add(62*time.Minute), nil),
+		checkTestEvent("bob", "list", "pods", hour.Add(time.Minute), nil),
+		checkTestEvent("bob", "get", "pods", hour.Add(time.Minute), nil),
+		checkTestEvent("bob", "get", "pods", hour.Add(time.Minute), nil),
+		checkTestEvent("system:serviceaccount:openshift-foo:bar", "get", "deployments", hour, deprecated),
+		checkTestEvent("system:serviceaccount:kube-system:bar", "get", "deployments", hour, deprecated),
+		{Stage: auditapi.StageRequestReceived, Verb: "list", ObjectRef: &auditapi.ObjectReference{Resource: "pods"}},
+	})
+
+	results := checker.Results()
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	budget := results[0]
+	if budget.Matched != 6 || len(budget.Violations) != 1 {
+		t.Fatalf("unexpected list pods budget result %+v", budget)
+	}
+	if v := budget.Violations[0]; v.Key != "user=alice" || !v.Window.Equal(hour) || v.Value != 3 {
+		t.Errorf("unexpected violation %+v", v)
+	}
+	if s := budget.Violations[0].String(budget.Rule); s != "user=alice in 2024-01-02T03:00:00Z/1h0m0s: count 3 > 2" {
+		t.Errorf("unexpected violation description %s", s)
+	}
+	if deprecatedResult := results[1]; len(deprecatedResult.Violations) != 1 || deprecatedResult.Violations[0].Key != "user=system:serviceaccount:openshift-foo:bar, resource=apps/v1/deployments" {
+		t.Errorf("unexpected deprecated APIs result %+v", deprecatedResult)
+	}
+	if slow := results[2]; slow.Matched != 10 || len(slow.Violations) != 0 {
+		t.Errorf("unexpected slow requests result %+v", slow)
+	}
+}
+
+func TestLoadCheckRulesInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":              "rules: []",
+		"unknown field":      "rules:\n- name: a\n  treshold: 1",
+		"no name":            "rules:\n- threshold: 1",
+		"duplicate":          "rules:\n- name: a\n- name: a",
+		"aggregation":        "rules:\n- name: a\n  aggregation: avg",
+		"group by":           "rules:\n- name: a\n  groupBy: [node]",
+		"window":             "rules:\n- name: a\n  window: hourly",
+		"negative window":    "rules:\n- name: a\n  window: -1h",
+		"negative threshold": "rules:\n- name: a\n  threshold: -1",
+		"glob":               "rules:\n- name: a\n  selector:\n    users: ['[']",
+	} {
+		if _, err := loadCheckRules(writeTestRules(t, content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCheckAuditLog(t *testing.T) {
+	rules, err := loadCheckRules(writeTestRules(t, "rules:\n- name: admin\n  selector:\n    users: [system:admin]\n  threshold: 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := newRuleChecker(rules)
+	source := aggregateSource{Input: writeTestAuditLog(t, testAuditLog)}
+	if _, err := aggregate(context.Background(), testLogger(), checker, aggregateConfig{Concurrency: 1, Parse: failOnParseError}, source); err != nil {
+		t.Fatal(err)
+	}
+	if results := checker.Results(); results[0].Matched != 1 || len(results[0].Violations) != 1 {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+}
+
+func TestCheckUnreadableAuditLog(t *testing.T) {
+	source := aggregateSource{Input: filepath.Join(t.TempDir(), "missing.log")}
+	conf := aggregateConfig{Concurrency: 1, Parse: failOnParseError}
+	if _, err := aggregate(context.Background(), testLogger(), newRuleChecker(&checkRules{}), conf, source); err != nil {
+		t.Fatalf("expected unreadable file to be only reported, got %v", err)
+	}
+	conf.Strict = true
+	_, err := aggregate(context.Background(), testLogger(), newRuleChecker(&checkRules{}), conf, source)
+	if err == nil || !strings.Contains(err.Error(), "missing.log") {
+		t.Errorf("expected strict aggregation to fail on unreadable file, got %v", err)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	passed := &checkRule{Name: "passed", Aggregation: aggregationCount}
+	failed := &checkRule{Name: "failed", Description: "Too many <lists>", Aggregation: aggregationCount, Threshold: 1}
+	var out bytes.Buffer
+	err := writeJUnit(&out, []ruleResult{
+		{Rule: passed, Matched: 1},
+		{Rule: failed, Matched: 5, Violations: []ruleViolation{{Key: "user=alice", Value: 5}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), xml.Header) {
+		t.Errorf("expected XML header in\n%s", out.String())
+	}
+	var decoded junitTestSuites
+	if err := xml.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Suites) != 1 || decoded.Suites[0].Tests != 2 || decoded.Suites[0].Failures != 1 {
+		t.Fatalf("unexpected suites %+v", decoded.Suites)
+	}
+	cases := decoded.Suites[0].TestCases
+	if cases[0].Name != "passed" || cases[0].Failure != nil {
+		t.Errorf("unexpected passed test case %+v", cases[0])
+	}
+	if cases[1].Failure == nil || cases[1].Failure.Text != "Too many <lists>\nuser=alice: count 5 > 1" {
+		t.Errorf("unexpected failed test case %+v", cases[1])
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const checkpointFileName = "follow-checkpoints.json"
+
+// checkpoint stores position in the followed file
+type checkpoint struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// checkpointStore persists byte offsets of followed files
+type checkpointStore struct {
+	mu          sync.Mutex
+	path        string
+	checkpoints map[string]checkpoint
+}
+
+func defaultCheckpointFile() string {
+	return filepath.Join(defaultCacheDir(), checkpointFileName)
+}
+
+// loadCheckpoints reads checkpoint file, missing file is treated as empty
+func loadCheckpoints(path string) (*checkpointStore, error) {
+	store := &checkpointStore{
+		path:        path,
+		checkpoints: map[string]checkpoint{},
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.checkpoints); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *checkpointStore) Get(path string) (checkpoint, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp, ok := s.checkpoints[path]
+	return cp, ok
+}
+
+// Save updates checkpoint for the file and writes all checkpoints to disk
+func (s *checkpointStore) Save(path string, cp checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[path] = cp
+
+	data, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// Write to temp file and rename it so that checkpoints are never half-written
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	diffDimensionClient   = "client"
+	diffDimensionResource = "resource"
+
+	metricRequestsPerMinute = "requests_per_minute"
+	metricErrorRate         = "error_rate"
+	metricP99               = "p99_ms"
+
+	diffStatusNew       = "new"
+	diffStatusGone      = "gone"
+	diffStatusIncreased = "increased"
+	diffStatusDecreased = "decreased"
+
+	defaultDiffCountThreshold   = 0.5
+	defaultDiffErrorThreshold   = 0.05
+	defaultDiffLatencyThreshold = 0.5
+	defaultDiffMinRequests      = 100
+	// minDatasetDuration prevents huge request rates of datasets spanning a few seconds
+	minDatasetDuration = time.Minute
+)
+
+// datasetStats counts completed requests of a client or a resource
+type datasetStats struct {
+	Requests uint64
+	Errors   uint64
+	Latency  *quantileSketch
+}
+
+func (s *datasetStats) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// auditDataset aggregates completed requests per client and resource, it's safe for concurrent use
+type auditDataset struct {
+	mu         sync.Mutex
+	events     int
+	first      time.Time
+	last       time.Time
+	dimensions map[string]map[string]*datasetStats
+}
+
+func newAuditDataset() *auditDataset {
+	return &auditDataset{dimensions: map[string]map[string]*datasetStats{
+		diffDimensionClient:   {},
+		diffDimensionResource: {},
+	}}
+}
+
+// Add counts completed requests, events added by audit-span are skipped
+func (d *auditDataset) Add(events []auditapi.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, event := range events {
+		if _, ok := event.Annotations[annotationTypeKey]; ok {
+			continue
+		}
+		if event.Stage != auditapi.StageResponseComplete {
+			continue
+		}
+		d.events++
+		if t := event.RequestReceivedTimestamp.Time; !t.IsZero() && (d.first.IsZero() || t.Before(d.first)) {
+			d.first = t
+		}
+		if t := event.StageTimestamp.Time; t.After(d.last) {
+			d.last = t
+		}
+		record := newEventRecord(event)
+		for dimension, key := range map[string]string{
+			diffDimensionClient:   eventUsername(record),
+			diffDimensionResource: eventResource(record),
+		} {
+			if len(key) == 0 {
+				continue
+			}
+			stats, ok := d.dimensions[dimension][key]
+			if !ok {
+				stats = &datasetStats{Latency: newQuantileSketch()}
+				d.dimensions[dimension][key] = stats
+			}
+			stats.Requests++
+			if event.ResponseStatus != nil && event.ResponseStatus.Code >= 400 {
+				stats.Errors++
+			}
+			if record.DurationMS != nil {
+				stats.Latency.Add(*record.DurationMS)
+			}
+		}
+	}
+}
+
+// Duration returns duration of the prow job run, or time between the first and the last request
+// if the dataset is not a prow job
+func (d *auditDataset) Duration(prowInfo ProwInfo) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	duration := d.last.Sub(d.first)
+	if !prowInfo.Started.IsZero() && prowInfo.Finished.After(prowInfo.Started) {
+		duration = prowInfo.Finished.Sub(prowInfo.Started)
+	}
+	return max(duration, minDatasetDuration)
+}
+
+// diffThresholds are minimal changes reported by diff
+type diffThresholds struct {
+	// Count is the relative change of requests per minute
+	Count float64
+	// ErrorRate is the absolute change of the share of failed requests
+	ErrorRate float64
+	// Latency is the relative change of p99 request duration
+	Latency float64
+	// MinRequests skips clients and resources with fewer requests in both datasets
+	MinRequests uint64
+}
+
+// diffChange is a metric of a client or a resource which changed beyond threshold
+type diffChange struct {
+	Dimension string  `json:"dimension"`
+	Key       string  `json:"key"`
+	Metric    string  `json:"metric"`
+	Before    float64 `json:"before"`
+	After     float64 `json:"after"`
+	// Change is relative for requests per minute and latency, absolute for error rate
+	Change     float64 `json:"change"`
+	Status     string  `json:"status"`
+	Regression bool    `json:"regression"`
+}
+
+// diffDataset describes a compared dataset
+type diffDataset struct {
+	Source          string  `json:"source"`
+	Events          int     `json:"events"`
+	DurationMinutes float64 `json:"duration_minutes"`
+}
+
+// diffResult is the outcome of comparing two datasets
+type diffResult struct {
+	Before      diffDataset  `json:"before"`
+	After       diffDataset  `json:"after"`
+	Changes     []diffChange `json:"changes"`
+	Regressions int          `json:"regressions"`
+}
+
+// compareDatasets reports clients and resources whose request rate, error rate or p99 latency changed
+// beyond thresholds. Request rates are normalized by dataset duration, so runs of different length
+// can be compared
+func compareDatasets(before, after *auditDataset, beforeDuration, afterDuration time.Duration, thresholds diffThresholds) []diffChange {
+	before.mu.Lock()
+	defer before.mu.Unlock()
+	after.mu.Lock()
+	defer after.mu.Unlock()
+
+	changes := []diffChange{}
+	for _, dimension := range []string{diffDimensionClient, diffDimensionResource} {
+		keys := map[string]bool{}
+		for key := range before.dimensions[dimension] {
+			keys[key] = true
+		}
+		for key := range after.dimensions[dimension] {
+			keys[key] = true
+		}
+		for key := range keys {
+			b, a := before.dimensions[dimension][key], after.dimensions[dimension][key]
+			if max(requests(b), requests(a)) < thresholds.MinRequests {
+				continue
+			}
+			change := diffChange{
+				Dimension: dimension,
+				Key:       key,
+				Metric:    metricRequestsPerMinute,
+				Before:    float64(requests(b)) / beforeDuration.Minutes(),
+				After:     float64(requests(a)) / afterDuration.Minutes(),
+			}
+			switch {
+			case b == nil:
+				change.Status = diffStatusNew
+				change.Regression = true
+				changes = append(changes, change)
+				continue
+			case a == nil:
+				change.Status = diffStatusGone
+				changes = append(changes, change)
+				continue
+			}
+			if c, ok := relativeChange(change, thresholds.Count); ok {
+				changes = append(changes, c)
+			}
+			errorRate := diffChange{
+				Dimension: dimension,
+				Key:       key,
+				Metric:    metricErrorRate,
+				Before:    b.ErrorRate(),
+				After:     a.ErrorRate(),
+				Change:    a.ErrorRate() - b.ErrorRate(),
+			}
+			if math.Abs(errorRate.Change) > thresholds.ErrorRate {
+				errorRate.Status, errorRate.Regression = changeStatus(errorRate.Change)
+				changes = append(changes, errorRate)
+			}
+			if b.Latency.Count() > 0 && a.Latency.Count() > 0 {
+				latency := diffChange{
+					Dimension: dimension,
+					Key:       key,
+					Metric:    metricP99,
+					Before:    b.Latency.Quantile(0.99),
+					After:     a.Latency.Quantile(0.99),
+				}
+				if c, ok := relativeChange(latency, thresholds.Latency); ok {
+					changes = append(changes, c)
+				}
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Regression != changes[j].Regression {
+			return changes[i].Regression
+		}
+		if changes[i].Dimension != changes[j].Dimension {
+			return changes[i].Dimension < changes[j].Dimension
+		}
+		if changes[i].Key != changes[j].Key {
+			return changes[i].Key < changes[j].Key
+		}
+		return changes[i].Metric > changes[j].Metric
+	})
+	return changes
+}
+
+func requests(s *datasetStats) uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.Requests
+}
+
+// relativeChange sets relative change and status of the change if it exceeds threshold
+func relativeChange(change diffChange, threshold float64) (diffChange, bool) {
+	if change.Before == 0 {
+		return change, false
+	}
+	change.Change = (change.After - change.Before) / change.Before
+	if math.Abs(change.Change) <= threshold {
+		return change, false
+	}
+	change.Status, change.Regression = changeStatus(change.Change)
+	return change, true
+}
+
+// changeStatus returns status of the change, any increase is a regression
+func changeStatus(change float64) (string, bool) {
+	if change > 0 {
+		return diffStatusIncreased, true
+	}
+	return diffStatusDecreased, false
+}
+
+// diffColumns are columns of the changes table
+var diffColumns = []string{"dimension", "key", "metric", "before", "after", "change", "status"}
+
+// writeDiff prints datasets summary and changes in the selected format
+func writeDiff(w io.Writer, result diffResult, format string) error {
+	if err := validateReportFormat(format); err != nil {
+		return err
+	}
+	switch format {
+	case reportFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case reportFormatMarkdown:
+		fmt.Fprintf(w, "Before: %s\n\nAfter: %s\n\nRegressions: %d\n", diffDatasetLine(result.Before), diffDatasetLine(result.After), result.Regressions)
+		if len(result.Changes) == 0 {
+			return nil
+		}
+		fmt.Fprintf(w, "\n| %s |\n|---|---|---|---:|---:|---:|---|\n", strings.Join(diffColumns, " | "))
+		for _, change := range result.Changes {
+			cells := diffCells(change)
+			for i := range cells {
+				cells[i] = markdownEscape(cells[i])
+			}
+			fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+		}
+		return nil
+	default:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Before: %s\nAfter: %s\nRegressions: %d\n", diffDatasetLine(result.Before), diffDatasetLine(result.After), result.Regressions)
+		if len(result.Changes) > 0 {
+			fmt.Fprintf(tw, "\n%s\n", strings.ToUpper(strings.Join(diffColumns, "\t")))
+			for _, change := range result.Changes {
+				fmt.Fprintf(tw, "%s\n", strings.Join(diffCells(change), "\t"))
+			}
+		}
+		return tw.Flush()
+	}
+}
+
+func diffDatasetLine(d diffDataset) string {
+	return fmt.Sprintf("%s (%d requests in %.1f minutes)", d.Source, d.Events, d.DurationMinutes)
+}
+
+func diffCells(c diffChange) []string {
+	change := ""
+	switch {
+	case c.Status == diffStatusNew || c.Status == diffStatusGone:
+	case c.Metric == metricErrorRate:
+		change = fmt.Sprintf("%+.3f", c.Change)
+	default:
+		change = fmt.Sprintf("%+.1f%%", c.Change*100)
+	}
+	status := c.Status
+	if c.Regression {
+		status += " (regression)"
+	}
+	return []string{c.Dimension, reportKey(c.Key), c.Metric, fmt.Sprintf("%.3f", c.Before), fmt.Sprintf("%.3f", c.After), change, status}
+}
+
+// aggregateDataset aggregates audit logs of the source, a source without completed requests is an error
+func aggregateDataset(ctx context.Context, logger *logrus.Logger, conf aggregateConfig, source aggregateSource) (*auditDataset, ProwInfo, error) {
+	dataset := newAuditDataset()
+	prowInfo, err := aggregate(ctx, logger, dataset, conf, source)
+	if err != nil {
+		return dataset, prowInfo, err
+	}
+	if dataset.events == 0 {
+		return dataset, prowInfo, fmt.Errorf("no completed requests found in %s", source)
+	}
+	return dataset, prowInfo, nil
+}
+
+// runDiff compares two audit datasets and exits with non-zero code if any client or resource regressed
+func runDiff(args []string) {
+	var (
+		thresholds diffThresholds
+		format     string
+	)
+	logger := setupLogger()
+
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	aggregateOpts := addAggregateFlags(fs)
+	fs.Float64Var(&thresholds.Count, "count-threshold", defaultDiffCountThreshold, "relative change of requests per minute reported, 0.5 is 50%")
+	fs.Float64Var(&thresholds.ErrorRate, "error-threshold", defaultDiffErrorThreshold, "absolute change of the share of failed requests reported, 0.05 is 5 percentage points")
+	fs.Float64Var(&thresholds.Latency, "latency-threshold", defaultDiffLatencyThreshold, "relative change of p99 request duration reported, 0.5 is 50%")
+	fs.Uint64Var(&thresholds.MinRequests, "min-requests", defaultDiffMinRequests, "skip clients and resources with fewer requests in both datasets")
+	fs.StringVar(&format, "format", reportFormatTable, fmt.Sprintf("output format: %s, %s or %s", reportFormatTable, reportFormatMarkdown, reportFormatJSON))
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] <before> <after>\n\nBefore and after are prow job URLs, archives, dirs or files with audit logs\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := validateReportFormat(format); err != nil {
+		logger.Fatal(err)
+	}
+	conf, err := aggregateOpts.AggregateConfig(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	ctx, stop := signalContext(logger)
+	defer stop()
+
+	// Comparing with a partially read dataset would report made up changes
+	conf.Strict = true
+	datasets := make([]*auditDataset, 2)
+	summaries := make([]diffDataset, 2)
+	durations := make([]time.Duration, 2)
+	for i, arg := range fs.Args() {
+		source, err := parseAggregateSource(arg)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		var prowInfo ProwInfo
+		datasets[i], prowInfo, err = aggregateDataset(ctx, logger, conf, source)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		durations[i] = datasets[i].Duration(prowInfo)
+		summaries[i] = diffDataset{
+			Source:          source.String(),
+			Events:          datasets[i].events,
+			DurationMinutes: durations[i].Minutes(),
+		}
+	}
+
+	result := diffResult{
+		Before:  summaries[0],
+		After:   summaries[1],
+		Changes: compareDatasets(datasets[0], datasets[1], durations[0], durations[1], thresholds),
+	}
+	for _, change := range result.Changes {
+		if change.Regression {
+			result.Regressions++
+		}
+	}
+	if err := writeDiff(os.Stdout, result, format); err != nil {
+		logger.Fatal(err)
+	}
+	if result.Regressions > 0 {
+		logger.WithFields(logrus.Fields{"regressions": result.Regressions}).Error("Request patterns regressed")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// diffTestEvents returns count completed requests of the user spread over a minute
+func diffTestEvents(user string, count int, code int32, duration time.Duration) []auditapi.Event {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := make([]auditapi.Event, 0, count)
+	for i := range count {
+		received := start.Add(time.Duration(i) * time.Minute / time.Duration(count))
+		events = append(events, auditapi.Event{
+			Stage:                    auditapi.StageResponseComplete,
+			Verb:                     "list",
+			User:                     authnv1.UserInfo{Username: user},
+			ObjectRef:                &auditapi.ObjectReference{APIVersion: "v1", Resource: "pods"},
+			ResponseStatus:           &metav1.Status{Code: code},
+			RequestReceivedTimestamp: metav1.NewMicroTime(received),
+			StageTimestamp:           metav1.NewMicroTime(received.Add(duration)),
+		})
+	}
+	return events
+}
+
+func findChange(changes []diffChange, dimension, key, metric string) *diffChange {
+	for i := range changes {
+		if changes[i].Dimension == dimension && changes[i].Key == key && changes[i].Metric == metric {
+			return &changes[i]
+		}
+	}
+	return nil
+}
+
+func TestCompareDatasets(t *testing.T) {
+	thresholds := diffThresholds{Count: 0.5, ErrorRate: 0.05, Latency: 0.5, MinRequests: 10}
+
+	before := newAuditDataset()
+	before.Add(diffTestEvents("steady", 100, 200, 10*time.Millisecond))
+	before.Add(diffTestEvents("chatty", 100, 200, 10*time.Millisecond))
+	before.Add(diffTestEvents("retired", 100, 200, 10*time.Millisecond))
+	before.Add(diffTestEvents("rare", 5, 200, 10*time.Millisecond))
+
+	after := newAuditDataset()
+	after.Add(diffTestEvents("steady", 100, 200, 10*time.Millisecond))
+	after.Add(diffTestEvents("chatty", 300, 200, 10*time.Millisecond))
+	after.Add(diffTestEvents("chatty", 100, 500, time.Second))
+	after.Add(diffTestEvents("newcomer", 50, 200, 10*time.Millisecond))
+	after.Add(diffTestEvents("rare", 9, 200, 10*time.Millisecond))
+
+	changes := compareDatasets(before, after, time.Minute, time.Minute, thresholds)
+
+	if c := findChange(changes, diffDimensionClient, "chatty", metricRequestsPerMinute); c == nil || c.Status != diffStatusIncreased || !c.Regression || c.Change != 3 {
+		t.Errorf("expected request rate regression of chatty client, got %+v", c)
+	}
+	if c := findChange(changes, diffDimensionClient, "chatty", metricErrorRate); c == nil || c.After != 0.25 || !c.Regression {
+		t.Errorf("expected error rate regression of chatty client, got %+v", c)
+	}
+	if c := findChange(changes, diffDimensionClient, "chatty", metricP99); c == nil || c.Status != diffStatusIncreased {
+		t.Errorf("expected p99 regression of chatty client, got %+v", c)
+	}
+	if c := findChange(changes, diffDimensionClient, "newcomer", metricRequestsPerMinute); c == nil || c.Status != diffStatusNew || !c.Regression {
+		t.Errorf("expected new client, got %+v", c)
+	}
+	if c := findChange(changes, diffDimensionClient, "retired", metricRequestsPerMinute); c == nil || c.Status != diffStatusGone || c.Regression {
+		t.Errorf("expected gone client, got %+v", c)
+	}
+	for _, key := range []string{"steady", "rare"} {
+		for _, metric := range []string{metricRequestsPerMinute, metricErrorRate, metricP99} {
+			if c := findChange(changes, diffDimensionClient, key, metric); c != nil {
+				t.Errorf("expected no change of %s, got %+v", key, c)
+			}
+		}
+	}
+	if c := findChange(changes, diffDimensionResource, "v1/pods", metricRequestsPerMinute); c == nil || c.Before != 305 || c.After != 559 {
+		t.Errorf("expected pods request rate change, got %+v", c)
+	}
+	if !changes[0].Regression || changes[len(changes)-1].Regression {
+		t.Errorf("expected regressions first, got %+v", changes)
+	}
+}
+
+func TestCompareDatasetsNormalizesByDuration(t *testing.T) {
+	before := newAuditDataset()
+	before.Add(diffTestEvents("client", 100, 200, 10*time.Millisecond))
+	after := newAuditDataset()
+	after.Add(diffTestEvents("client", 200, 200, 10*time.Millisecond))
+
+	started := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	afterDuration := after.Duration(ProwInfo{Started: started, Finished: started.Add(2 * time.Hour)})
+	if afterDuration != 2*time.Hour {
+		t.Fatalf("expected duration of prow job run, got %s", afterDuration)
+	}
+	changes := compareDatasets(before, after, time.Hour, afterDuration, diffThresholds{Count: 0.5, ErrorRate: 0.05, Latency: 0.5})
+	if c := findChange(changes, diffDimensionClient, "client", metricRequestsPerMinute); c != nil {
+		t.Errorf("expected same request rate in twice longer run, got %+v", c)
+	}
+	if d := before.Duration(ProwInfo{}); d != minDatasetDuration {
+		t.Errorf("expected observed duration clamped to %s, got %s", minDatasetDuration, d)
+	}
+}
+
+func TestAggregateSourceDir(t *testing.T) {
+	path := writeTestAuditLog(t, testAuditLog)
+	source, err := parseAggregateSource(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.AuditLogDir != filepath.Dir(path) {
+		t.Fatalf("expected audit log dir source, got %+v", source)
+	}
+	dataset := newAuditDataset()
+	if _, err := aggregate(context.Background(), testLogger(), dataset, aggregateConfig{Concurrency: 1, Parse: failOnParseError}, source); err != nil {
+		t.Fatal(err)
+	}
+	if dataset.events != 2 || requests(dataset.dimensions[diffDimensionClient]["system:admin"]) != 1 {
+		t.Errorf("unexpected dataset %+v", dataset.dimensions)
+	}
+}
+
+func TestAggregateDatasetFailsWithoutRequests(t *testing.T) {
+	conf := aggregateConfig{Concurrency: 1, Parse: failOnParseError, Strict: true}
+	dir := t.TempDir()
+	for name, source := range map[string]aggregateSource{
+		"unreadable": {Input: filepath.Join(dir, "missing.log")},
+		"empty":      {Input: writeTestAuditLog(t, "")},
+	} {
+		if _, _, err := aggregateDataset(context.Background(), testLogger(), conf, source); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	dataset, _, err := aggregateDataset(context.Background(), testLogger(), conf, aggregateSource{Input: writeTestAuditLog(t, testAuditLog)})
+	if err != nil || dataset.events != 2 {
+		t.Errorf("expected dataset of 2 events, got %v", err)
+	}
+}
+
+func TestAuditDatasetCountsCompletedRequests(t *testing.T) {
+	dataset := newAuditDataset()
+	events := diffTestEvents("client", 2, 200, 10*time.Millisecond)
+	events[1].Stage = auditapi.StagePanic
+	dataset.Add(events)
+	if stats := dataset.dimensions[diffDimensionClient]["client"]; dataset.events != 1 || stats.Requests != 1 || stats.Errors != 0 {
+		t.Errorf("expected only completed request to be counted, got %d events and %+v", dataset.events, stats)
+	}
+}
+
+func TestParseAggregateSource(t *testing.T) {
+	for arg, expected := range map[string]aggregateSource{
+		"https://prow.ci.openshift.org/view/gs/test-platform-results/logs/job/123": {ProwJob: "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/job/123"},
+		"https://example.com/audit.tar.gz":                                         {Input: "https://example.com/audit.tar.gz"},
+		"must-gather.zip":                                                          {Input: "must-gather.zip"},
+		stdinPath:                                                                  {Input: stdinPath},
+	} {
+		source, err := parseAggregateSource(arg)
+		if err != nil {
+			t.Errorf("%s: %v", arg, err)
+			continue
+		}
+		if source != expected {
+			t.Errorf("%s: expected %+v, got %+v", arg, expected, source)
+		}
+	}
+	if _, err := parseAggregateSource(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing path")
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	result := diffResult{
+		Before: diffDataset{Source: "before", Events: 10, DurationMinutes: 1},
+		After:  diffDataset{Source: "after", Events: 30, DurationMinutes: 1},
+		Changes: []diffChange{
+			{Dimension: diffDimensionClient, Key: "a|b", Metric: metricRequestsPerMinute, Before: 10, After: 30, Change: 2, Status: diffStatusIncreased, Regression: true},
+			{Dimension: diffDimensionClient, Key: "c", Metric: metricErrorRate, Before: 0.1, After: 0, Change: -0.1, Status: diffStatusDecreased},
+		},
+		Regressions: 1,
+	}
+	var out bytes.Buffer
+	if err := writeDiff(&out, result, reportFormatMarkdown); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Regressions: 1", `| client | a\|b | requests_per_minute | 10.000 | 30.000 | +200.0% | increased (regression) |`, "| -0.100 | decreased |"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := writeDiff(&out, result, reportFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded diffResult
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Regressions != 1 || len(decoded.Changes) != 2 || decoded.Changes[0].Key != "a|b" {
+		t.Errorf("unexpected decoded diff %+v", decoded)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const defaultFollowPollInterval = time.Second
+
+// FollowConfig stores settings for tailing live audit log
+type FollowConfig struct {
+	PollInterval time.Duration
+	Checkpoints  *checkpointStore
+}
+
+// fileFollower tails audit log file, following it across rename-based rotation
+type fileFollower struct {
+	logger *logrus.Logger
+	path   string
+	conf   FollowConfig
+	parser *lineParser
+	sink   Sink
+
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	saved   checkpoint
+	pending []byte
+	batch   []auditapi.Event
+}
+
+// followAuditLog ships events from the live audit log file until context is cancelled
+func followAuditLog(ctx context.Context, logger *logrus.Logger, path string, sink Sink, parseConf ParseConfig, conf FollowConfig) error {
+	if conf.PollInterval <= 0 {
+		conf.PollInterval = defaultFollowPollInterval
+	}
+	f := &fileFollower{
+		logger: logger,
+		path:   path,
+		conf:   conf,
+		parser: newLineParser(logger, path, parseConf),
+		sink:   sink,
+	}
+	defer f.parser.Close()
+
+	if err := f.open(true); err != nil {
+		return err
+	}
+	defer func() {
+		f.file.Close()
+	}()
+
+	err := f.run(ctx)
+	// Ship whatever was read before exiting
+	return errors.Join(err, f.flush())
+}
+
+// open opens the followed path, resuming from checkpoint if the file was not rotated since
+func (f *fileFollower) open(resume bool) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	offset := int64(0)
+	if cp, ok := f.conf.Checkpoints.Get(f.path); resume && ok {
+		if cp.Inode == fileInode(info) && cp.Offset <= info.Size() {
+			offset = cp.Offset
+		} else {
+			f.logger.WithFields(logrus.Fields{"path": f.path}).Info("File was rotated since last checkpoint, reading from start")
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.info = info
+	f.offset = offset
+	f.reader = bufio.NewReader(file)
+	f.pending = f.pending[:0]
+	f.logger.WithFields(logrus.Fields{"path": f.path, "offset": offset}).Info("Following audit log")
+	return nil
+}
+
+func (f *fileFollower) run(ctx context.Context) error {
+	rotated := false
+	for {
+		line, err := f.reader.ReadBytes('\n')
+		f.pending = append(f.pending, line...)
+		if err == nil {
+			if err := f.handleLine(); err != nil {
+				return err
+			}
+			// Stop reading a large backlog on shutdown, the checkpoint resumes from here
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+
+		// Reached the end of the file, ship what was read so far
+		if err := f.flush(); err != nil {
+			return err
+		}
+
+		if rotated {
+			// Old file was drained, switch to the new one
+			if len(f.pending) > 0 {
+				f.logger.WithFields(logrus.Fields{"path": f.path, "bytes": len(f.pending)}).Warning("Discarding incomplete line in rotated file")
+			}
+			f.file.Close()
+			if err := f.open(false); err != nil {
+				return err
+			}
+			rotated = false
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(f.conf.PollInterval):
+		}
+
+		current, err := os.Stat(f.path)
+		switch {
+		case os.IsNotExist(err):
+			// File was renamed, new one is not created yet
+			continue
+		case err != nil:
+			return err
+		case !os.SameFile(f.info, current):
+			f.logger.WithFields(logrus.Fields{"path": f.path}).Info("Audit log rotated")
+			rotated = true
+		case current.Size() < f.offset:
+			f.logger.WithFields(logrus.Fields{"path": f.path}).Info("Audit log truncated, reading from start")
+			if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			f.offset = 0
+			f.pending = f.pending[:0]
+			f.reader.Reset(f.file)
+		}
+	}
+}
+
+// handleLine parses complete line from pending buffer
+func (f *fileFollower) handleLine() error {
+	f.offset += int64(len(f.pending))
+	data := bytes.TrimRight(f.pending, "\r\n")
+	defer func() {
+		f.pending = f.pending[:0]
+	}()
+	if len(data) == 0 {
+		return nil
+	}
+
+	event, ok, err := f.parser.Parse(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", f.path, err)
+	}
+	if ok {
+		f.batch = append(f.batch, event)
+	}
+	if len(f.batch) >= sinkBatchSize {
+		return f.flush()
+	}
+	return nil
+}
+
+// flush sends current batch and saves checkpoint once the backend has accepted it or the batch was spooled.
+// Otherwise the batch is kept and checkpoint is not moved past it, so following resumes from it after restart
+func (f *fileFollower) flush() error {
+	if len(f.batch) > 0 {
+		if err := f.send(); err != nil {
+			return err
+		}
+		f.batch = f.batch[:0]
+	}
+
+	cp := checkpoint{
+		Inode:  fileInode(f.info),
+		Offset: f.offset,
+	}
+	if cp == f.saved {
+		return nil
+	}
+	if err := f.conf.Checkpoints.Save(f.path, cp); err != nil {
+		return err
+	}
+	f.saved = cp
+	return nil
+}
+
+// send writes current batch to the sink and flushes it, spooled batch can be replayed so it's not an error
+func (f *fileFollower) send() error {
+	err := f.sink.WriteBatch(f.batch)
+	if err == nil {
+		err = f.sink.Flush()
+	}
+	var spooled *spooledError
+	if errors.As(err, &spooled) {
+		f.logger.WithFields(logrus.Fields{"path": f.path}).Warning(err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send events of %s: %v", f.path, err)
+	}
+	return nil
+}
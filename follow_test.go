@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendToFile(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowAuditLogAcrossRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	lines := strings.SplitAfter(testAuditLog, "\n")
+	appendToFile(t, path, lines[0])
+
+	checkpoints, err := loadCheckpoints(filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := FollowConfig{
+		PollInterval: 10 * time.Millisecond,
+		Checkpoints:  checkpoints,
+	}
+	sink := &memorySink{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- followAuditLog(ctx, testLogger(), path, sink, failOnParseError, conf)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	// Line written right before rotation must not be lost
+	appendToFile(t, path, lines[1])
+	if err := os.Rename(path, filepath.Join(dir, "audit-2024-09-16T10-00-00.000.log")); err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(t, path, testAuditLog)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(sink.events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(sink.events))
+	}
+	cp, ok := checkpoints.Get(path)
+	if !ok || cp.Offset != int64(len(testAuditLog)) {
+		t.Errorf("expected checkpoint at offset %d, got %+v", len(testAuditLog), cp)
+	}
+}
+
+func TestFollowAuditLogStopsReadingBacklog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	appendToFile(t, path, strings.Repeat(testAuditLog, 1000))
+	firstLine := strings.SplitAfter(testAuditLog, "\n")[0]
+
+	checkpoints, err := loadCheckpoints(filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sink := &memorySink{}
+	conf := FollowConfig{PollInterval: 10 * time.Millisecond, Checkpoints: checkpoints}
+	if err := followAuditLog(ctx, testLogger(), path, sink, failOnParseError, conf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(sink.events) != 1 {
+		t.Fatalf("expected to stop after the first line, got %d events", len(sink.events))
+	}
+	cp, ok := checkpoints.Get(path)
+	if !ok || cp.Offset != int64(len(firstLine)) {
+		t.Errorf("expected checkpoint at offset %d, got %+v", len(firstLine), cp)
+	}
+}
+
+// flushFailingSink fails to flush with err
+type flushFailingSink struct {
+	memorySink
+	err error
+}
+
+func (s *flushFailingSink) Flush() error {
+	s.flushes++
+	return s.err
+}
+
+func TestFollowAuditLogKeepsCheckpointOnFailedFlush(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err        error
+		checkpoint bool
+	}{
+		"failed":  {err: errors.New("backend is down")},
+		"spooled": {err: &spooledError{err: errors.New("backend is down"), path: "batch.json"}, checkpoint: true},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "audit.log")
+		appendToFile(t, path, testAuditLog)
+		checkpoints, err := loadCheckpoints(filepath.Join(dir, "checkpoints.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		sink := &flushFailingSink{err: tc.err}
+		conf := FollowConfig{PollInterval: 10 * time.Millisecond, Checkpoints: checkpoints}
+		err = followAuditLog(ctx, testLogger(), path, sink, failOnParseError, conf)
+		cancel()
+
+		cp, ok := checkpoints.Get(path)
+		if tc.checkpoint {
+			if err != nil {
+				t.Errorf("%s: expected to keep following, got %v", name, err)
+			}
+			if !ok || cp.Offset != int64(len(testAuditLog)) {
+				t.Errorf("%s: expected checkpoint past spooled batch, got %+v", name, cp)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "backend is down") {
+			t.Errorf("%s: expected flush error to stop following, got %v", name, err)
+		}
+		if ok {
+			t.Errorf("%s: expected no checkpoint past failed batch, got %+v", name, cp)
+		}
+		// The batch is kept and sent again on exit
+		if len(sink.events) != 4 {
+			t.Errorf("%s: expected failed batch to be sent again, got %d events", name, len(sink.events))
+		}
+	}
+}
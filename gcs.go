@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	gcsAPIPath       = "/storage/v1"
+	gcsListPageSize  = "1000"
+	gcsListFields    = "items(name,size),prefixes,nextPageToken"
+	prowViewPrefix   = "/view/"
+	prowLogsPath     = "logs"
+	prowDeckURL      = "https://prow.ci.openshift.org"
+	prowViewStorage  = "gs"
+	gcswebPathPrefix = "gcs"
+	httpTimeout      = 10 * time.Second
+)
+
+var errNoAuditLogsTar = errors.New("no " + promTarPath + " found")
+
+// gcsObject is an item returned by GCS JSON API object listing
+type gcsObject struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+// gcsObjectList is a page of GCS JSON API object listing
+type gcsObjectList struct {
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+// prowJobLocation is a bucket and a path to prowjob artifacts in GCS
+type prowJobLocation struct {
+	Bucket string
+	Path   string
+}
+
+// parseProwJobURL extracts GCS bucket and job path from Prow or gcsweb URL, e.g.
+// https://prow.ci.openshift.org/view/gs/test-platform-results/logs/<job>/<build> or
+// https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/test-platform-results/logs/<job>/<build>/
+func parseProwJobURL(prowJobURL *url.URL) (prowJobLocation, error) {
+	p := strings.TrimPrefix(prowJobURL.Path, prowViewPrefix)
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) < 3 || (segments[0] != prowViewStorage && segments[0] != gcswebPathPrefix) {
+		return prowJobLocation{}, fmt.Errorf("failed to find GCS bucket in %s", prowJobURL)
+	}
+	return prowJobLocation{
+		Bucket: segments[1],
+		Path:   strings.Join(segments[2:], "/"),
+	}, nil
+}
+
+// artifactLocator finds audit logs tarball of the prowjob
+type artifactLocator struct {
+	logger    *logrus.Logger
+	netClient *http.Client
+	// storageURL serves objects as <storageURL>/<bucket>/<name> and JSON API at <storageURL>/storage/v1
+	storageURL string
+}
+
+func newArtifactLocator(logger *logrus.Logger) *artifactLocator {
+	return &artifactLocator{
+		logger: logger,
+		netClient: &http.Client{
+			Timeout: httpTimeout,
+		},
+		storageURL: storagePrefix,
+	}
+}
+
+// Locate finds audit logs tarball via GCS JSON API, falling back to scraping gcsweb pages
+func (l *artifactLocator) Locate(prowJobURL *url.URL) (ProwInfo, error) {
+	prowInfo, err := l.locateViaAPI(prowJobURL)
+	// Listing is complete, scraping gcsweb would not find the tarball either
+	if err == nil || errors.Is(err, errNoAuditLogsTar) {
+		return prowInfo, err
+	}
+	l.logger.WithFields(logrus.Fields{"url": prowJobURL.String(), "error": err}).Warning("Failed to list artifacts via GCS API, scraping gcsweb")
+	return getTarURLFromProw(l.logger, l.netClient, l.storageURL, prowJobURL)
+}
+
+func (l *artifactLocator) locateViaAPI(prowJobURL *url.URL) (ProwInfo, error) {
+	location, err := parseProwJobURL(prowJobURL)
+	if err != nil {
+		return ProwInfo{}, err
+	}
+	return l.LocateBuild(location)
+}
+
+// LocateBuild finds audit logs tarballs of the job run via GCS JSON API
+func (l *artifactLocator) LocateBuild(location prowJobLocation) (ProwInfo, error) {
+	prowInfo := ProwInfo{}
+	objects, _, err := l.listObjects(location.Bucket, location.Path+"/", "")
+	if err != nil {
+		return prowInfo, err
+	}
+	tarName, err := pickAuditLogsTar(objects)
+	if err != nil {
+		return prowInfo, fmt.Errorf("%w in gs://%s/%s", err, location.Bucket, location.Path)
+	}
+	for _, name := range findAuditLogsTars(objects) {
+		tar := newAuditLogsTar(l.objectURL(location.Bucket, name))
+		l.logger.WithFields(logrus.Fields{"target": tar.Target, "step": tar.Step, "url": tar.URL}).Info("Found audit logs tarball")
+		prowInfo.AuditLogsTars = append(prowInfo.AuditLogsTars, tar)
+	}
+
+	if err := prowInfo.fetchRunInfo(l.objectURL(location.Bucket, location.Path), location); err != nil {
+		return prowInfo, err
+	}
+
+	prowInfo.AuditLogsTarURL = l.objectURL(location.Bucket, tarName)
+	return prowInfo, nil
+}
+
+// ListBuilds returns IDs of the job runs stored in the bucket, newest first
+func (l *artifactLocator) ListBuilds(bucket, job string) ([]string, error) {
+	jobPrefix := path.Join(prowLogsPath, job) + "/"
+	_, prefixes, err := l.listObjects(bucket, jobPrefix, "/")
+	if err != nil {
+		return nil, err
+	}
+	builds := []uint64{}
+	for _, prefix := range prefixes {
+		// Build IDs are increasing numbers, other directories are not runs
+		id, err := strconv.ParseUint(path.Base(prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		builds = append(builds, id)
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i] > builds[j] })
+
+	result := make([]string, 0, len(builds))
+	for _, id := range builds {
+		result = append(result, strconv.FormatUint(id, 10))
+	}
+	return result, nil
+}
+
+// listObjects returns all objects in the bucket with the given name prefix. If delimiter is set
+// objects in subdirectories are not returned, their common prefixes are returned instead
+func (l *artifactLocator) listObjects(bucket, prefix, delimiter string) ([]gcsObject, []string, error) {
+	objects := []gcsObject{}
+	prefixes := []string{}
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		if len(delimiter) > 0 {
+			query.Set("delimiter", delimiter)
+		}
+		query.Set("fields", gcsListFields)
+		query.Set("maxResults", gcsListPageSize)
+		if len(pageToken) > 0 {
+			query.Set("pageToken", pageToken)
+		}
+		listURL := fmt.Sprintf("%s%s/b/%s/o?%s", l.storageURL, gcsAPIPath, url.PathEscape(bucket), query.Encode())
+
+		page, err := l.listPage(listURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, page.Items...)
+		prefixes = append(prefixes, page.Prefixes...)
+		if len(page.NextPageToken) == 0 {
+			return objects, prefixes, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (l *artifactLocator) listPage(listURL string) (gcsObjectList, error) {
+	var page gcsObjectList
+	resp, err := l.netClient.Get(listURL)
+	if err != nil {
+		return page, fmt.Errorf("failed to fetch %s: %v", listURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return page, fmt.Errorf("failed to list objects at %s: returned %s", listURL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return page, fmt.Errorf("failed to parse object list at %s: %v", listURL, err)
+	}
+	return page, nil
+}
+
+// Job returns name of the job, location path is logs/<job>/<build>
+func (p prowJobLocation) Job() string {
+	if len(p.Path) == 0 {
+		return ""
+	}
+	return path.Base(path.Dir(p.Path))
+}
+
+// BuildID returns ID of the job run
+func (p prowJobLocation) BuildID() string {
+	if len(p.Path) == 0 {
+		return ""
+	}
+	return path.Base(p.Path)
+}
+
+// ViewURL returns Prow page of the job run
+func (p prowJobLocation) ViewURL() string {
+	return fmt.Sprintf("%s%s%s/%s/%s", prowDeckURL, prowViewPrefix, prowViewStorage, p.Bucket, p.Path)
+}
+
+func (l *artifactLocator) objectURL(bucket, name string) string {
+	return fmt.Sprintf("%s/%s/%s", l.storageURL, bucket, name)
+}
+
+// findAuditLogsTars returns names of all audit logs tarballs in the listing, sorted
+func findAuditLogsTars(objects []gcsObject) []string {
+	result := []string{}
+	for _, object := range objects {
+		if path.Base(object.Name) == promTarPath && object.Size != "0" {
+			result = append(result, object.Name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// pickAuditLogsTar chooses audit logs tarball from e2e target, preferring the ones
+// collected by gather steps, same as gcsweb scraper does
+func pickAuditLogsTar(objects []gcsObject) (string, error) {
+	tars := findAuditLogsTars(objects)
+	if len(tars) == 0 {
+		return "", errNoAuditLogsTar
+	}
+	best, bestScore := "", -1
+	for _, name := range tars {
+		score := 0
+		for _, segment := range strings.Split(name, "/") {
+			switch {
+			case segment == extraPath || segment == hypershiftExtraPath:
+				score += 2
+			case strings.Contains(segment, e2ePrefix):
+				score++
+			}
+		}
+		// Tarballs are sorted, so ties are resolved deterministically
+		if score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	defaultGCSBucket   = "test-platform-results"
+	defaultHistoryRuns = 10
+	jobWindowStream    = "prow-job-window"
+)
+
+// HistoryConfig stores settings for importing recent runs of a job
+type HistoryConfig struct {
+	Job    string
+	Bucket string
+	Last   int
+	Step   string
+	// Cache stores downloaded tarballs, nil to download them to temp dir. Streamed tarballs are
+	// stored only if it caches them
+	Cache *downloadCache
+	// ExtractToDisk extracts audit logs to temp dir instead of streaming them from tarballs
+	ExtractToDisk bool
+}
+
+// importRunKey identifies import of the run, importing other steps later is not skipped
+func importRunKey(prowjob, stepGlob string) string {
+	return prowjob + "#" + stepGlob
+}
+
+// importProwJobHistory imports audit logs of the last runs of the job.
+// Runs imported already and runs without audit logs are skipped
+func importProwJobHistory(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, locator *artifactLocator, conf IngestConfig, historyConf HistoryConfig) error {
+	builds, err := locator.ListBuilds(historyConf.Bucket, historyConf.Job)
+	if err != nil {
+		return fmt.Errorf("failed to list runs of %s: %v", historyConf.Job, err)
+	}
+	if historyConf.Last > 0 && len(builds) > historyConf.Last {
+		builds = builds[:historyConf.Last]
+	}
+	logger.WithFields(logrus.Fields{"job": historyConf.Job, "runs": len(builds)}).Info("Found job runs")
+
+	var (
+		errs     []error
+		imported int
+		skipped  int
+	)
+	for _, buildID := range builds {
+		if ctx.Err() != nil {
+			break
+		}
+		location := prowJobLocation{
+			Bucket: historyConf.Bucket,
+			Path:   path.Join(prowLogsPath, historyConf.Job, buildID),
+		}
+		runConf := conf
+		runConf.ProwJob = location.ViewURL()
+		if conf.Latency != nil {
+			// Each run gets its own latency summary
+			runConf.Latency = newLatencyAggregator()
+		}
+		runKey := importRunKey(runConf.ProwJob, historyConf.Step)
+		if conf.State != nil && !conf.Force && conf.State.RunImported(runKey) {
+			logger.WithFields(logrus.Fields{"build_id": buildID}).Info("Run imported already, skipping, use --force to re-import")
+			skipped++
+			continue
+		}
+
+		err := importRun(ctx, logger, sinks, locator, runConf, location, historyConf)
+		switch {
+		case errors.Is(err, errNoAuditLogsTar):
+			logger.WithFields(logrus.Fields{"build_id": buildID, "reason": err}).Info("Run has no audit logs, skipping")
+			skipped++
+		case err != nil:
+			errs = append(errs, fmt.Errorf("failed to import run %s: %v", buildID, err))
+		default:
+			imported++
+		}
+	}
+	logger.WithFields(logrus.Fields{"imported": imported, "skipped": skipped, "failed": len(errs)}).Info("Job history imported")
+
+	errs = append(errs, ctx.Err())
+	return errors.Join(errs...)
+}
+
+// importRun sends audit logs of a single run to sinks, streaming them from tarballs
+// unless they should be extracted to disk
+func importRun(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, locator *artifactLocator, conf IngestConfig, location prowJobLocation, historyConf HistoryConfig) error {
+	prowInfo, err := locator.LocateBuild(location)
+	if err != nil {
+		return err
+	}
+	if !historyConf.ExtractToDisk {
+		return streamRun(ctx, logger, sinks, conf, historyConf.Cache, prowInfo, historyConf.Step)
+	}
+	download, err := downloadAuditLogs(logger, historyConf.Cache, prowInfo, historyConf.Step)
+	if len(download.Dir) > 0 {
+		defer os.RemoveAll(download.Dir)
+	}
+	if err != nil {
+		return err
+	}
+	return ingestRun(ctx, logger, sinks, conf, download, historyConf.Step)
+}
+
+// ingestRun sends audit logs extracted from the job run tarballs and marks the run as imported
+func ingestRun(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, download prowJobDownload, stepGlob string) error {
+	auditLogFiles, err := findAuditLogsInDir(logger, download.Dir)
+	if err != nil {
+		return err
+	}
+	conf.FileLabels = download.FileLabels
+	conf.BaseDir = download.Dir
+	if conf.OnlyDuringTest {
+		conf.Parse.Window = download.Info.Window()
+	}
+	if err := ingestFiles(ctx, logger, sinks, conf, auditLogFiles); err != nil {
+		return err
+	}
+	return finishRun(logger, sinks, conf, download.Info, stepGlob)
+}
+
+// streamRun sends audit logs from the job run tarballs selected by step glob without extracting them
+// and marks the run as imported
+func streamRun(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, cache *downloadCache, prowInfo ProwInfo, stepGlob string) error {
+	tars, err := selectAuditLogsTars(prowInfo, stepGlob)
+	if err != nil {
+		return err
+	}
+	if conf.OnlyDuringTest {
+		conf.Parse.Window = prowInfo.Window()
+	}
+	if len(conf.Parse.QuarantineDir) == 0 {
+		// Streamed audit logs have no dir to put quarantine file next to
+		conf.Parse.QuarantineDir = "."
+	}
+	var errs []error
+	for _, tar := range tars {
+		labels := prowInfo.Labels()
+		for k, v := range tar.Labels() {
+			labels[k] = v
+		}
+		if err := streamAuditLogsTar(ctx, logger, sinks, conf, cache, tar, labels); err != nil {
+			errs = append(errs, err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return finishRun(logger, sinks, conf, prowInfo, stepGlob)
+}
+
+// finishRun sends latency summary and annotation of the job window and marks the run as imported
+func finishRun(logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, prowInfo ProwInfo, stepGlob string) error {
+	if err := sendLatencySummary(logger, sinks, conf, prowInfo.Labels()); err != nil {
+		return err
+	}
+	runKey := importRunKey(conf.ProwJob, stepGlob)
+	if conf.State != nil && !conf.Force && conf.State.RunImported(runKey) {
+		// Annotation was sent when the run was imported
+		return nil
+	}
+	if err := sendJobWindowAnnotation(logger, sinks, conf, prowInfo); err != nil {
+		return err
+	}
+	if conf.State == nil {
+		return nil
+	}
+	if err := conf.State.MarkRunImported(runKey); err != nil {
+		return fmt.Errorf("failed to save import state: %v", err)
+	}
+	return nil
+}
+
+// sendJobWindowAnnotation sends event marking the job window to a separate stream
+func sendJobWindowAnnotation(logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, prowInfo ProwInfo) error {
+	if prowInfo.Started.IsZero() {
+		return nil
+	}
+	if err := sendComputedEvents(sinks, conf, jobWindowStream, prowInfo.Labels(), []auditapi.Event{prowInfo.AnnotationEvent()}); err != nil {
+		return fmt.Errorf("failed to send job window annotation: %v", err)
+	}
+	logger.WithFields(logrus.Fields{"job": prowInfo.Job, "build_id": prowInfo.BuildID, "started": prowInfo.Started, "finished": prowInfo.Finished}).Info("Job window annotation sent")
+	return nil
+}
+
+// sendLatencySummary sends latency quantiles of imported requests to a separate stream
+func sendLatencySummary(logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, labels map[string]string) error {
+	if conf.Latency == nil {
+		return nil
+	}
+	if conf.Latency.Partial() {
+		logger.WithFields(logrus.Fields{"prowjob": conf.ProwJob}).Info("Some files were imported before, skipping latency summary, use --force to re-import")
+		return nil
+	}
+	events := conf.Latency.Events()
+	if len(events) == 0 {
+		return nil
+	}
+	if err := sendComputedEvents(sinks, conf, latencySummaryStream, labels, events); err != nil {
+		return fmt.Errorf("failed to send latency summary: %v", err)
+	}
+	logger.WithFields(logrus.Fields{"prowjob": conf.ProwJob, "summaries": len(events)}).Info("Latency summary sent")
+	return nil
+}
+
+// sendComputedEvents sends events computed by audit-span to a separate stream named after the kind of events
+func sendComputedEvents(sinks *sinkTracker, conf IngestConfig, stream string, labels map[string]string, events []auditapi.Event) error {
+	sinkConf := conf.Sink
+	sinkConf.Labels = map[string]string{}
+	for k, v := range labels {
+		sinkConf.Labels[k] = v
+	}
+	sinkConf.Labels["prowjob"] = conf.ProwJob
+	sinkConf.Labels["filename"] = stream
+	trackedPath := sinkPath(conf, stream)
+	sink, err := sinks.Open(conf.SinkName, trackedPath, sinkConf)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if err := sink.WriteBatch(events); err != nil {
+		errs = append(errs, err)
+	}
+	if err := sinks.Close(trackedPath); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testSinkName = "test-memory"
+
+// recordedSinks stores sinks opened via test sink along with their labels
+var recordedSinks struct {
+	sync.Mutex
+	labels []map[string]string
+	sinks  []*memorySink
+}
+
+func init() {
+	registerSink(testSinkName, func(logger *logrus.Logger, conf SinkConfig) (Sink, error) {
+		recordedSinks.Lock()
+		defer recordedSinks.Unlock()
+		sink := &memorySink{}
+		recordedSinks.labels = append(recordedSinks.labels, conf.Labels)
+		recordedSinks.sinks = append(recordedSinks.sinks, sink)
+		return sink, nil
+	})
+}
+
+// resetRecordedSinks forgets sinks opened by previous tests
+func resetRecordedSinks() {
+	recordedSinks.Lock()
+	defer recordedSinks.Unlock()
+	recordedSinks.labels = nil
+	recordedSinks.sinks = nil
+}
+
+// gzipBytes compresses data with gzip
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testAuditLogsTar builds audit-logs.tar as collected by gather step: gzipped tar of gzipped logs
+func testAuditLogsTar(t *testing.T) []byte {
+	t.Helper()
+	member := gzipBytes(t, []byte(testAuditLog))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: "audit_logs/kube-apiserver/master-0-audit.log.gz", Mode: 0644, Size: int64(len(member))}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(member); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return gzipBytes(t, buf.Bytes())
+}
+
+func TestImportProwJobHistory(t *testing.T) {
+	job := "periodic-e2e-aws"
+	tarObject := "/artifacts/e2e-aws/gather-audit-logs/artifacts/audit-logs.tar"
+	tarball := testAuditLogsTar(t)
+
+	pages := map[string]string{}
+	for _, build := range []string{"100", "200", "300"} {
+		pages["/bucket/logs/"+job+"/"+build+"/started.json"] = testStartedJSON
+		pages["/bucket/logs/"+job+"/"+build+"/finished.json"] = testFinishJSON
+	}
+	server := newTestGCSServer(t, pages, func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		if r.URL.Query().Get("delimiter") == "/" {
+			fmt.Fprintf(w, `{"prefixes":["logs/%[1]s/100/","logs/%[1]s/300/","logs/%[1]s/latest/","logs/%[1]s/200/"]}`, job)
+			return
+		}
+		// Run 200 has failed before audit logs were collected
+		if strings.Contains(prefix, "/200/") {
+			fmt.Fprint(w, `{"items":[]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"items":[{"name":"%s%s","size":"%d"}]}`, strings.TrimSuffix(prefix, "/"), tarObject, len(tarball))
+	})
+	// Tarballs are served with range support, as GCS does
+	pagesHandler := server.Config.Handler
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bucket/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, tarObject) {
+			http.ServeContent(w, r, "audit-logs.tar", time.Now(), bytes.NewReader(tarball))
+			return
+		}
+		pagesHandler.ServeHTTP(w, r)
+	})
+	mux.Handle("/", pagesHandler)
+	server.Config.Handler = mux
+
+	state, err := loadImportState(filepath.Join(t.TempDir(), "imports.json"), testSinkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := IngestConfig{
+		SinkName: testSinkName,
+		Parse:    failOnParseError,
+		State:    state,
+	}
+	historyConf := HistoryConfig{
+		Job:    job,
+		Bucket: "bucket",
+		Last:   2,
+	}
+	importHistory := func() {
+		t.Helper()
+		sinks := newSinkTracker(testLogger())
+		if err := importProwJobHistory(context.Background(), testLogger(), sinks, testLocator(server), conf, historyConf); err != nil {
+			t.Fatal(err)
+		}
+		if err := sinks.CloseAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resetRecordedSinks()
+	importHistory()
+	recordedSinks.Lock()
+	if len(recordedSinks.sinks) != 2 {
+		t.Fatalf("expected only run 300 to be imported, got %d streams", len(recordedSinks.sinks))
+	}
+	labels := recordedSinks.labels[0]
+	if labels["build_id"] != "300" || labels["job"] != job || labels["result"] != "SUCCESS" || labels["started"] != "2024-09-16T10:00:00Z" {
+		t.Errorf("unexpected run labels %v", labels)
+	}
+	if labels["step"] != "gather-audit-logs" || labels["target"] != "e2e-aws" {
+		t.Errorf("unexpected step labels %v", labels)
+	}
+	if labels["filename"] != "e2e-aws/gather-audit-logs/kube-apiserver/master-0-audit.log" {
+		t.Errorf("unexpected filename label %s", labels["filename"])
+	}
+	if !strings.HasSuffix(labels["prowjob"], "/view/gs/bucket/logs/"+job+"/300") {
+		t.Errorf("unexpected prowjob label %s", labels["prowjob"])
+	}
+	if events := len(recordedSinks.sinks[0].events); events != 2 {
+		t.Errorf("expected 2 events, got %d", events)
+	}
+
+	// Job window annotation is sent to a separate stream once the run is imported
+	if filename := recordedSinks.labels[1]["filename"]; filename != jobWindowStream {
+		t.Errorf("expected annotation stream, got %s", filename)
+	}
+	annotation := recordedSinks.sinks[1].events
+	if len(annotation) != 1 || annotation[0].Annotations[annotationTypeKey] != jobWindowAnnotation {
+		t.Fatalf("expected job window annotation, got %v", annotation)
+	}
+	if !annotation[0].StageTimestamp.Equal(&metav1.MicroTime{Time: time.Unix(1726480800, 0)}) || annotation[0].Annotations[annotationKeyPrefix+"finished"] != "2024-09-16T11:00:00Z" {
+		t.Errorf("unexpected annotation window %v", annotation[0])
+	}
+	recordedSinks.Unlock()
+
+	// Second import skips the run imported already
+	importHistory()
+	recordedSinks.Lock()
+	defer recordedSinks.Unlock()
+	if len(recordedSinks.sinks) != 2 {
+		t.Errorf("expected imported run to be skipped, got %d streams", len(recordedSinks.sinks))
+	}
+}
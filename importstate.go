@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	importStateFileName = "imports.json"
+	// Sink is flushed and import state is saved every checkpointEvents events
+	checkpointEvents = 10000
+)
+
+// importRecord stores how much of the audit log file was shipped
+type importRecord struct {
+	// ID identifies file contents, SHA-256 digest for local files
+	ID          string `json:"id"`
+	Destination string `json:"destination,omitempty"`
+	ProwJob     string `json:"prowjob"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+	// Offset in decompressed data up to which events were acknowledged by the sink
+	Offset int64 `json:"offset"`
+	// Last acknowledged event, used to verify resume position
+	LastAuditID string    `json:"lastAuditID,omitempty"`
+	LastStage   string    `json:"lastStage,omitempty"`
+	Complete    bool      `json:"complete"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// importStateFile is the on-disk format of import state
+type importStateFile struct {
+	Files map[string]importRecord `json:"files"`
+	// Runs stores when all selected audit logs of prowjob runs were imported
+	Runs map[string]time.Time `json:"runs"`
+}
+
+// importState persists import records so that re-runs skip already shipped files. Records are kept
+// per destination, so importing to another sink or backend address doesn't skip files
+type importState struct {
+	mu          sync.Mutex
+	path        string
+	destination string
+	records     map[string]importRecord
+	runs        map[string]time.Time
+}
+
+func defaultImportStateFile() string {
+	return filepath.Join(defaultCacheDir(), importStateFileName)
+}
+
+// loadImportState reads state file of imports to the destination, missing file is treated as empty
+func loadImportState(path, destination string) (*importState, error) {
+	state := &importState{
+		path:        path,
+		destination: destination,
+		records:     map[string]importRecord{},
+		runs:        map[string]time.Time{},
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stateFile importStateFile
+	if err := json.Unmarshal(data, &stateFile); err != nil {
+		return nil, err
+	}
+	for k, v := range stateFile.Files {
+		state.records[k] = v
+	}
+	for k, v := range stateFile.Runs {
+		state.runs[k] = v
+	}
+	return state, nil
+}
+
+// importKey identifies file contents imported for a prowjob to the destination, temporary paths differ between runs
+func importKey(destination, prowjob, id string) string {
+	return destination + "#" + prowjob + "/" + id
+}
+
+// Begin returns import of the file, resuming previous progress unless force is set
+func (s *importState) Begin(prowjob, path string, force bool) (*fileImport, error) {
+	size, digest, err := fileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	imp := s.begin(prowjob, path, digest, size, force)
+	imp.record.SHA256 = digest
+	return imp, nil
+}
+
+// BeginStream returns import of the audit log which can't be hashed before reading, e.g. tarball member.
+// id must change if contents change
+func (s *importState) BeginStream(prowjob, name, id string, size int64, force bool) *fileImport {
+	return s.begin(prowjob, name, id, size, force)
+}
+
+func (s *importState) begin(prowjob, path, id string, size int64, force bool) *fileImport {
+	record := importRecord{
+		ID:          id,
+		Destination: s.destination,
+		ProwJob:     prowjob,
+		Path:        path,
+		Size:        size,
+	}
+
+	s.mu.Lock()
+	previous, ok := s.records[importKey(s.destination, prowjob, id)]
+	s.mu.Unlock()
+	if ok && !force {
+		record.Offset = previous.Offset
+		record.LastAuditID = previous.LastAuditID
+		record.LastStage = previous.LastStage
+		record.Complete = previous.Complete
+	}
+	return &fileImport{state: s, record: record}
+}
+
+// RunImported returns true if the run was marked as imported
+func (s *importState) RunImported(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.runs[s.destination+"#"+key]
+	return ok
+}
+
+// MarkRunImported records that all audit logs of the run were imported
+func (s *importState) MarkRunImported(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[s.destination+"#"+key] = time.Now()
+	return s.write()
+}
+
+func (s *importState) save(record importRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record.UpdatedAt = time.Now()
+	s.records[importKey(record.Destination, record.ProwJob, record.ID)] = record
+	return s.write()
+}
+
+// write stores the state to disk, must be called with the lock held
+func (s *importState) write() error {
+	data, err := json.MarshalIndent(importStateFile{Files: s.records, Runs: s.runs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// Write to temp file and rename it so that state is never half-written
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// fileImport tracks shipping progress of a single file
+type fileImport struct {
+	state  *importState
+	record importRecord
+}
+
+// Complete returns true if the file was fully shipped already
+func (i *fileImport) Complete() bool {
+	return i.record.Complete
+}
+
+// ResumeOffset returns offset in decompressed data to resume from
+func (i *fileImport) ResumeOffset() int64 {
+	return i.record.Offset
+}
+
+// VerifyResume checks that the last skipped event matches the last shipped one
+func (i *fileImport) VerifyResume(event auditapi.Event) bool {
+	if len(i.record.LastAuditID) == 0 {
+		return true
+	}
+	return string(event.AuditID) == i.record.LastAuditID && string(event.Stage) == i.record.LastStage
+}
+
+// Shipped records that all events up to offset were acknowledged
+func (i *fileImport) Shipped(offset int64, last auditapi.Event) error {
+	i.record.Offset = offset
+	i.record.LastAuditID = string(last.AuditID)
+	i.record.LastStage = string(last.Stage)
+	return i.state.save(i.record)
+}
+
+// Finish marks the file as fully shipped
+func (i *fileImport) Finish() error {
+	i.record.Complete = true
+	return i.state.save(i.record)
+}
+
+func fileDigest(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportStateSkipsCompletedFile(t *testing.T) {
+	path := writeTestAuditLog(t, testAuditLog)
+	statePath := filepath.Join(t.TempDir(), "imports.json")
+
+	state, err := loadImportState(statePath, testSinkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp, err := state.Begin("job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memorySink{}
+	if _, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, sink, failOnParseError, imp); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(sink.events))
+	}
+
+	// State is persisted, so a new run sees the file as imported
+	state, err = loadImportState(statePath, testSinkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp, err = state.Begin("job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imp.Complete() {
+		t.Error("expected file to be imported already")
+	}
+	imp, err = state.Begin("job", path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Complete() || imp.ResumeOffset() != 0 {
+		t.Error("expected forced import to start from scratch")
+	}
+	imp, err = state.Begin("other-job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Complete() {
+		t.Error("expected file to be imported again for another prowjob")
+	}
+}
+
+func TestImportStateIsKeptPerDestination(t *testing.T) {
+	path := writeTestAuditLog(t, testAuditLog)
+	statePath := filepath.Join(t.TempDir(), "imports.json")
+	lokiConf := SinkConfig{LokiAddr: "http://loki-1/push"}
+
+	state, err := loadImportState(statePath, sinkDestination(sinkLoki, lokiConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp, err := state.Begin("job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imp.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.MarkRunImported("job#*"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, destination := range map[string]string{
+		"other address": sinkDestination(sinkLoki, SinkConfig{LokiAddr: "http://loki-2/push"}),
+		"other sink":    sinkDestination(sinkVlogsJSONLine, SinkConfig{LokiAddr: lokiConf.LokiAddr}),
+	} {
+		other, err := loadImportState(statePath, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imp, err := other.Begin("job", path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imp.Complete() || other.RunImported("job#*") {
+			t.Errorf("%s: expected file and run to be imported again", name)
+		}
+	}
+
+	state, err = loadImportState(statePath, sinkDestination(sinkLoki, lokiConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp, err = state.Begin("job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imp.Complete() || !state.RunImported("job#*") {
+		t.Error("expected file and run imported to the same destination to be skipped")
+	}
+}
+
+func TestImportStateResumesPartialImport(t *testing.T) {
+	path := writeTestAuditLog(t, testAuditLog)
+	state, err := loadImportState(filepath.Join(t.TempDir(), "imports.json"), testSinkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(testAuditLog, "\n")
+
+	imp, err := state.Begin("job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := decodeAuditEvent([]byte(lines[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imp.Shipped(int64(len(lines[0])), first); err != nil {
+		t.Fatal(err)
+	}
+
+	imp, err = state.Begin("job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memorySink{}
+	if _, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, sink, failOnParseError, imp); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 1 || sink.events[0].AuditID != "a2" {
+		t.Fatalf("expected only a2 to be sent, got %d events", len(sink.events))
+	}
+
+	// Resume position pointing to another event means the state is stale
+	first.AuditID = "other"
+	if err := imp.Shipped(int64(len(lines[0])), first); err != nil {
+		t.Fatal(err)
+	}
+	imp.record.Complete = false
+	if _, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, &memorySink{}, failOnParseError, imp); err == nil {
+		t.Error("expected resume mismatch error")
+	}
+}
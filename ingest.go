@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IngestConfig stores settings for sending a set of audit log files
+type IngestConfig struct {
+	SinkName    string
+	Sink        SinkConfig
+	ProwJob     string
+	Concurrency int
+	Parse       ParseConfig
+	// FileLabels stores extra stream labels of each file, e.g. prow job step
+	FileLabels map[string]map[string]string
+	// BaseDir is a dir audit log files are named relative to in stream labels
+	BaseDir string
+	// State records imported files, nil disables skipping and resuming
+	State *importState
+	// Force re-imports files even if they were imported already
+	Force bool
+	// OnlyDuringTest drops events of prow job runs outside of the job window
+	OnlyDuringTest bool
+	// Latency estimates request latency quantiles of sent events, nil disables latency summary
+	Latency *latencyAggregator
+}
+
+// ingestFiles parses audit log files and sends them to sinks using a bounded pool of workers
+func ingestFiles(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, auditLogFiles []string) error {
+	concurrency := conf.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		errs      errorCollector
+		processed int
+		badLines  = map[string]int{}
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fileCh := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for auditLogPath := range fileCh {
+				stats, err := ingestFile(ctx, logger, sinks, conf, auditLogPath)
+				errs.Add(err)
+
+				mu.Lock()
+				processed++
+				if stats.BadLines > 0 {
+					badLines[auditLogPath] = stats.BadLines
+				}
+				logger.WithFields(logrus.Fields{"path": auditLogPath, "processed": processed, "total": len(auditLogFiles)}).Info("File processed")
+				mu.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for _, auditLogPath := range auditLogFiles {
+		select {
+		case fileCh <- auditLogPath:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(fileCh)
+	wg.Wait()
+
+	printBadLinesSummary(logger, auditLogFiles, badLines)
+
+	errs.Add(ctx.Err())
+	return errs.Err()
+}
+
+func ingestFile(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, auditLogPath string) (parseStats, error) {
+	var imp *fileImport
+	// Stdin can't be read twice to compute the digest
+	if conf.State != nil && auditLogPath != stdinPath {
+		var err error
+		imp, err = conf.State.Begin(conf.ProwJob, auditLogPath, conf.Force)
+		if err != nil {
+			return parseStats{}, fmt.Errorf("failed to check import state of %s: %v", auditLogPath, err)
+		}
+	}
+	return ingestAuditLog(ctx, logger, sinks, conf, auditLogPath, func() (io.ReadCloser, error) { return openAuditLog(auditLogPath) }, imp)
+}
+
+// ingestAuditLog sends audit log opened by open to the sink labelled with auditLogPath,
+// skipping it if import state shows it was imported already
+func ingestAuditLog(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, auditLogPath string, open openFunc, imp *fileImport) (parseStats, error) {
+	if conf.Latency != nil && imp != nil && (imp.Complete() || imp.ResumeOffset() > 0) {
+		// Summary would miss events imported before
+		conf.Latency.MarkPartial()
+	}
+	if imp != nil && imp.Complete() {
+		logger.WithFields(logrus.Fields{"path": auditLogPath}).Info("Already imported, skipping, use --force to re-import")
+		return parseStats{}, nil
+	}
+
+	sinkConf := conf.Sink
+	sinkConf.Labels = fileLabels(conf, auditLogPath)
+	trackedPath := sinkPath(conf, auditLogPath)
+	sink, err := sinks.Open(conf.SinkName, trackedPath, sinkConf)
+	if err != nil {
+		return parseStats{}, err
+	}
+	if conf.Latency != nil {
+		sink = &latencySink{Sink: sink, latency: conf.Latency}
+	}
+	var errs []error
+	stats, err := sendAuditLog(ctx, logger, auditLogPath, open, sink, conf.Parse, imp)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if err := sinks.Close(trackedPath); err != nil {
+		errs = append(errs, err)
+	}
+	return stats, errors.Join(errs...)
+}
+
+// sinkPath returns the key sink of the file is tracked by. Runs of a prow job stream members
+// with the same names, so the key is prefixed with the run
+func sinkPath(conf IngestConfig, name string) string {
+	if len(conf.ProwJob) == 0 {
+		return name
+	}
+	return conf.ProwJob + "#" + name
+}
+
+// fileLabels returns stream labels of the audit log file
+func fileLabels(conf IngestConfig, auditLogPath string) map[string]string {
+	name := streamName(conf, auditLogPath)
+	labels := map[string]string{"prowjob": conf.ProwJob, "filename": name}
+	for k, v := range auditLogLabels(name) {
+		labels[k] = v
+	}
+	for k, v := range conf.FileLabels[auditLogPath] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// streamName returns name of audit log file in stream labels, relative to base dir
+// so that it doesn't depend on temp dir the file is extracted to
+func streamName(conf IngestConfig, auditLogPath string) string {
+	if auditLogPath == stdinPath || len(conf.BaseDir) == 0 {
+		return auditLogName(auditLogPath)
+	}
+	rel, err := filepath.Rel(conf.BaseDir, auditLogPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return auditLogPath
+	}
+	// Extracted files are named same as the streamed ones
+	return strings.TrimSuffix(filepath.ToSlash(rel), ".gz")
+}
+
+// printBadLinesSummary reports malformed lines found in each file
+func printBadLinesSummary(logger *logrus.Logger, auditLogFiles []string, badLines map[string]int) {
+	if len(badLines) == 0 {
+		return
+	}
+	total := 0
+	for _, auditLogPath := range auditLogFiles {
+		count, ok := badLines[auditLogPath]
+		if !ok {
+			continue
+		}
+		total += count
+		logger.WithFields(logrus.Fields{"path": auditLogPath, "bad": count}).Warning("Malformed lines")
+	}
+	logger.WithFields(logrus.Fields{"files": len(badLines), "bad": total}).Warning("Total malformed lines")
+}
+
+// followFile ships events from live audit log file until context is cancelled
+func followFile(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, followConf FollowConfig, auditLogPath string) error {
+	sinkConf := conf.Sink
+	sinkConf.Labels = fileLabels(conf, auditLogPath)
+	sink, err := sinks.Open(conf.SinkName, auditLogPath, sinkConf)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if err := followAuditLog(ctx, logger, auditLogPath, sink, conf.Parse, followConf); err != nil {
+		errs = append(errs, err)
+	}
+	if err := sinks.Close(auditLogPath); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
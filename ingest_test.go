@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const testSlowSinkName = "test-slow"
+
+// slowSinkStats records how many slow sinks were writing at once
+var slowSinkStats struct {
+	sync.Mutex
+	active    int
+	maxActive int
+	events    int
+}
+
+// slowSink takes a while to write each batch so that workers overlap
+type slowSink struct {
+	memorySink
+}
+
+func (s *slowSink) WriteBatch(events []auditapi.Event) error {
+	slowSinkStats.Lock()
+	slowSinkStats.active++
+	slowSinkStats.maxActive = max(slowSinkStats.maxActive, slowSinkStats.active)
+	slowSinkStats.events += len(events)
+	slowSinkStats.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	slowSinkStats.Lock()
+	slowSinkStats.active--
+	slowSinkStats.Unlock()
+	return s.memorySink.WriteBatch(events)
+}
+
+func init() {
+	registerSink(testSlowSinkName, func(logger *logrus.Logger, conf SinkConfig) (Sink, error) {
+		return &slowSink{}, nil
+	})
+}
+
+func resetSlowSinkStats() {
+	slowSinkStats.Lock()
+	defer slowSinkStats.Unlock()
+	slowSinkStats.active = 0
+	slowSinkStats.maxActive = 0
+	slowSinkStats.events = 0
+}
+
+// writeTestAuditLogs writes n copies of test audit log to a dir
+func writeTestAuditLogs(t *testing.T, n int) []string {
+	t.Helper()
+	dir := t.TempDir()
+	paths := make([]string, 0, n)
+	for i := range n {
+		path := filepath.Join(dir, fmt.Sprintf("audit-%d.log", i))
+		if err := os.WriteFile(path, []byte(testAuditLog), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestIngestFilesBoundsConcurrency(t *testing.T) {
+	resetSlowSinkStats()
+	files := writeTestAuditLogs(t, 8)
+	sinks := newSinkTracker(testLogger())
+	conf := IngestConfig{SinkName: testSlowSinkName, Concurrency: 3, Parse: failOnParseError}
+	if err := ingestFiles(context.Background(), testLogger(), sinks, conf, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinks.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	slowSinkStats.Lock()
+	defer slowSinkStats.Unlock()
+	if slowSinkStats.events != 2*len(files) {
+		t.Errorf("expected %d events, got %d", 2*len(files), slowSinkStats.events)
+	}
+	if slowSinkStats.maxActive < 2 || slowSinkStats.maxActive > 3 {
+		t.Errorf("expected 2 to 3 files processed at once, got %d", slowSinkStats.maxActive)
+	}
+}
+
+func TestIngestFilesCancelled(t *testing.T) {
+	resetSlowSinkStats()
+	files := writeTestAuditLogs(t, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sinks := newSinkTracker(testLogger())
+	conf := IngestConfig{SinkName: testSlowSinkName, Concurrency: 2, Parse: failOnParseError}
+	err := ingestFiles(ctx, testLogger(), sinks, conf, files)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled error, got %v", err)
+	}
+	sinks.CloseAll()
+
+	slowSinkStats.Lock()
+	defer slowSinkStats.Unlock()
+	if slowSinkStats.events == 2*len(files) {
+		t.Error("expected cancelled ingest to stop before all files are sent")
+	}
+}
+
+func TestIngestFilesCollectsErrors(t *testing.T) {
+	files := append(writeTestAuditLogs(t, 2), filepath.Join(t.TempDir(), "missing.log"))
+	sinks := newSinkTracker(testLogger())
+	conf := IngestConfig{SinkName: testSlowSinkName, Concurrency: 2, Parse: failOnParseError}
+	err := ingestFiles(context.Background(), testLogger(), sinks, conf, files)
+	if err == nil || !strings.Contains(err.Error(), "missing.log") {
+		t.Errorf("expected error of missing file, got %v", err)
+	}
+	sinks.CloseAll()
+}
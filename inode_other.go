@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode is not supported on this platform, checkpoints are matched by path only
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
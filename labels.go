@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	nodeLabel       = "node"
+	apiserverLabel  = "apiserver"
+	rotationLabel   = "rotation"
+	currentRotation = "current"
+)
+
+// apiserverKinds are dirs audit logs of each apiserver are stored in on nodes and in must-gather
+var apiserverKinds = []string{"kube-apiserver", "openshift-apiserver", "oauth-apiserver"}
+
+// rotatedAuditLogRe matches audit log file names: audit.log, audit-<time>.log or <node>-audit-<time>.log.gz.
+// Rotated files are suffixed with the rotation time, so time is used as generation of the file
+var rotatedAuditLogRe = regexp.MustCompile(`^(?:(.+)-)?audit(?:-(.+?))?\.log(?:\.(?:gz|zst|bz2|xz))?$`)
+
+// isApiserverKind returns true if dir is named after one of known apiservers
+func isApiserverKind(dir string) bool {
+	for _, kind := range apiserverKinds {
+		if dir == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveMemberPath returns path of audit log archive member to store it at: <apiserver>/<node>/<file>
+// if member is in apiserver dir as in must-gather, or <node>/<file> otherwise
+func archiveMemberPath(memberName string) string {
+	segments := strings.Split(memberName, "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		if isApiserverKind(segments[i]) {
+			return path.Join(segments[i:]...)
+		}
+	}
+	return path.Join(segments[len(segments)-2:]...)
+}
+
+// auditLogLabels derives node, apiserver and rotation labels from the audit log path.
+// Labels which can't be derived are omitted
+func auditLogLabels(auditLogPath string) map[string]string {
+	labels := map[string]string{}
+	segments := strings.Split(filepath.ToSlash(auditLogPath), "/")
+	base := segments[len(segments)-1]
+	dirs := segments[:len(segments)-1]
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if isApiserverKind(dirs[i]) {
+			labels[apiserverLabel] = dirs[i]
+			// Node dir follows apiserver dir in must-gather layout
+			if i+1 < len(dirs) {
+				labels[nodeLabel] = dirs[i+1]
+			}
+			break
+		}
+	}
+
+	match := rotatedAuditLogRe.FindStringSubmatch(base)
+	if match == nil {
+		return labels
+	}
+	switch prefix := match[1]; {
+	case isApiserverKind(prefix):
+		// Files named after apiserver are stored in node dirs
+		labels[apiserverLabel] = prefix
+		if len(dirs) > 0 {
+			labels[nodeLabel] = dirs[len(dirs)-1]
+		}
+	case len(prefix) > 0:
+		// Audit logs collected by CI are prefixed with node name
+		labels[nodeLabel] = prefix
+	}
+	labels[rotationLabel] = currentRotation
+	if len(match[2]) > 0 {
+		labels[rotationLabel] = match[2]
+	}
+	return labels
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLogLabels(t *testing.T) {
+	for name, expected := range map[string]map[string]string{
+		"kube-apiserver/master-0/audit.log": {
+			"apiserver": "kube-apiserver", "node": "master-0", "rotation": "current",
+		},
+		"e2e-aws/gather-audit-logs/openshift-apiserver/master-1/audit-2024-09-16T10-00-00.000.log": {
+			"apiserver": "openshift-apiserver", "node": "master-1", "rotation": "2024-09-16T10-00-00.000",
+		},
+		"e2e-aws/gather-audit-logs/oauth-apiserver/ip-10-0-1-2.ec2.internal-audit-2024-09-16T10-00-00.000.log.gz": {
+			"apiserver": "oauth-apiserver", "node": "ip-10-0-1-2.ec2.internal", "rotation": "2024-09-16T10-00-00.000",
+		},
+		"master-0/kube-apiserver-audit-2024-09-16T10-00-00.000.log": {
+			"apiserver": "kube-apiserver", "node": "master-0", "rotation": "2024-09-16T10-00-00.000",
+		},
+		"/var/log/kube-apiserver/audit.log": {
+			"apiserver": "kube-apiserver", "rotation": "current",
+		},
+		"stdin":      {},
+		"events.log": {},
+	} {
+		labels := auditLogLabels(name)
+		if len(labels) != len(expected) {
+			t.Errorf("expected labels %v of %s, got %v", expected, name, labels)
+			continue
+		}
+		for k, v := range expected {
+			if labels[k] != v {
+				t.Errorf("expected labels %v of %s, got %v", expected, name, labels)
+				break
+			}
+		}
+	}
+}
+
+func TestArchiveMemberPath(t *testing.T) {
+	for member, expected := range map[string]string{
+		"must-gather.local.1/image/audit_logs/kube-apiserver/master-0/audit.log.gz": "kube-apiserver/master-0/audit.log.gz",
+		"audit_logs/kube-apiserver/master-0-audit.log.gz":                           "kube-apiserver/master-0-audit.log.gz",
+		"audit-logs/master-0/kube-apiserver-audit.log.gz":                           "master-0/kube-apiserver-audit.log.gz",
+	} {
+		if actual := archiveMemberPath(member); actual != expected {
+			t.Errorf("expected %s to be stored at %s, got %s", member, expected, actual)
+		}
+	}
+}
+
+func TestStreamName(t *testing.T) {
+	dir := t.TempDir()
+	conf := IngestConfig{BaseDir: dir}
+	if name := streamName(conf, filepath.Join(dir, "e2e", "gather", "kube-apiserver", "master-0-audit.log.gz")); name != "e2e/gather/kube-apiserver/master-0-audit.log" {
+		t.Errorf("expected name relative to base dir, got %s", name)
+	}
+	if name := streamName(conf, "/var/log/audit.log"); name != "/var/log/audit.log" {
+		t.Errorf("expected path outside of base dir to be kept, got %s", name)
+	}
+	if name := streamName(conf, stdinPath); name != "stdin" {
+		t.Errorf("expected stdin, got %s", name)
+	}
+}
+
+func TestLokiLabelsEscaping(t *testing.T) {
+	labels := lokiLabels(map[string]string{
+		"filename": `dir/"quoted"\name`,
+		"build-id": "1",
+		"0node":    "master-0",
+	})
+	expected := `{_0node="master-0", build_id="1", filename="dir/\"quoted\"\\name"}`
+	if labels != expected {
+		t.Errorf("expected %s, got %s", expected, labels)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	latencyAnnotationPrefix = "apiserver.latency.k8s.io/"
+	latencyField            = "latency_ms"
+	durationField           = "duration_ms"
+)
+
+// eventRecord is audit event with numeric fields derived at ingest time, sinks send it instead of the raw event
+type eventRecord struct {
+	auditapi.Event
+	// LatencyMS stores apiserver.latency.k8s.io/* annotations in milliseconds, keyed by annotation name without the prefix
+	LatencyMS map[string]float64 `json:"latency_ms,omitempty"`
+	// DurationMS is the time between receiving the request and the event stage in milliseconds
+	DurationMS *float64 `json:"duration_ms,omitempty"`
+}
+
+func newEventRecord(event auditapi.Event) eventRecord {
+	record := eventRecord{
+		Event:     event,
+		LatencyMS: latencyAnnotations(event.Annotations),
+	}
+	// Timestamps of events added by audit-span are not request timestamps
+	_, computed := event.Annotations[annotationTypeKey]
+	if !computed && !event.RequestReceivedTimestamp.IsZero() && !event.StageTimestamp.IsZero() {
+		duration := durationMS(event.StageTimestamp.Sub(event.RequestReceivedTimestamp.Time))
+		record.DurationMS = &duration
+	}
+	return record
+}
+
+// latencyAnnotations decodes Go duration strings of apiserver latency annotations, e.g. "1.234567ms",
+// and quantiles of latency summaries. Annotations which are not durations are skipped
+func latencyAnnotations(annotations map[string]string) map[string]float64 {
+	var result map[string]float64
+	for k, v := range annotations {
+		name, ok := strings.CutPrefix(k, latencyAnnotationPrefix)
+		if !ok {
+			name, ok = strings.CutPrefix(k, summaryLatencyPrefix)
+		}
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			continue
+		}
+		if result == nil {
+			result = map[string]float64{}
+		}
+		result[name] = durationMS(d)
+	}
+	return result
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	latencySummaryAnnotation = "latency-summary"
+	latencySummaryStream     = "latency-summary"
+	// summaryLatencyPrefix annotations store quantiles of latency summary as Go durations, e.g. audit-span/latency-p99
+	summaryLatencyPrefix = annotationKeyPrefix + "latency-"
+	summaryCountKey      = annotationKeyPrefix + "count"
+)
+
+// latencyKey groups requests in latency summary
+type latencyKey struct {
+	Username    string
+	Verb        string
+	APIGroup    string
+	APIVersion  string
+	Resource    string
+	Subresource string
+}
+
+func newLatencyKey(e eventRecord) latencyKey {
+	key := latencyKey{
+		Username: e.User.Username,
+		Verb:     e.Verb,
+	}
+	if e.ObjectRef != nil {
+		key.APIGroup = e.ObjectRef.APIGroup
+		key.APIVersion = e.ObjectRef.APIVersion
+		key.Resource = e.ObjectRef.Resource
+		key.Subresource = e.ObjectRef.Subresource
+	}
+	return key
+}
+
+// GroupResource returns group/version/resource/subresource of the key, group is omitted for the core group
+func (k latencyKey) GroupResource() string {
+	parts := []string{}
+	for _, part := range []string{k.APIGroup, k.APIVersion, k.Resource, k.Subresource} {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// latencyEntry is a sketch of request durations with the time range of the requests
+type latencyEntry struct {
+	sketch *quantileSketch
+	first  time.Time
+	last   time.Time
+}
+
+// latencyAggregator estimates quantiles of request durations per user, verb and resource,
+// it's safe for concurrent use
+type latencyAggregator struct {
+	mu      sync.Mutex
+	entries map[latencyKey]*latencyEntry
+	// partial is set if some events were imported before and can't be summarized
+	partial bool
+}
+
+func newLatencyAggregator() *latencyAggregator {
+	return &latencyAggregator{entries: map[latencyKey]*latencyEntry{}}
+}
+
+// Add counts durations of completed requests, events added by audit-span are skipped
+func (a *latencyAggregator) Add(events []auditapi.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, event := range events {
+		if _, ok := event.Annotations[annotationTypeKey]; ok || event.Stage != auditapi.StageResponseComplete {
+			continue
+		}
+		record := newEventRecord(event)
+		if record.DurationMS == nil {
+			continue
+		}
+		key := newLatencyKey(record)
+		entry, ok := a.entries[key]
+		if !ok {
+			entry = &latencyEntry{sketch: newQuantileSketch()}
+			a.entries[key] = entry
+		}
+		entry.sketch.Add(*record.DurationMS)
+		entry.add(event.RequestReceivedTimestamp.Time, event.StageTimestamp.Time)
+	}
+}
+
+// MarkPartial records that some events were imported before, e.g. a file was skipped or resumed
+func (a *latencyAggregator) MarkPartial() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.partial = true
+}
+
+// Partial returns true if the summary would not cover all imported events
+func (a *latencyAggregator) Partial() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.partial
+}
+
+// Merge adds sketches of other aggregator
+func (a *latencyAggregator) Merge(other *latencyAggregator) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, otherEntry := range other.entries {
+		entry, ok := a.entries[key]
+		if !ok {
+			entry = &latencyEntry{sketch: newQuantileSketch()}
+			a.entries[key] = entry
+		}
+		entry.sketch.Merge(otherEntry.sketch)
+		entry.add(otherEntry.first, otherEntry.last)
+	}
+}
+
+func (e *latencyEntry) add(first, last time.Time) {
+	if e.first.IsZero() || first.Before(e.first) {
+		e.first = first
+	}
+	if last.After(e.last) {
+		e.last = last
+	}
+}
+
+// latencySummary is the estimated request duration quantiles of a user, verb and resource
+type latencySummary struct {
+	Key      latencyKey `json:"-"`
+	Username string     `json:"username"`
+	Verb     string     `json:"verb"`
+	Resource string     `json:"resource"`
+	Count    uint64     `json:"count"`
+	SumMS    float64    `json:"sum_ms"`
+	P50MS    float64    `json:"p50_ms"`
+	P90MS    float64    `json:"p90_ms"`
+	P99MS    float64    `json:"p99_ms"`
+	MaxMS    float64    `json:"max_ms"`
+	First    time.Time  `json:"-"`
+	Last     time.Time  `json:"-"`
+}
+
+// Quantiles returns estimated quantiles by name
+func (s latencySummary) Quantiles() map[string]float64 {
+	return map[string]float64{"p50": s.P50MS, "p90": s.P90MS, "p99": s.P99MS, "max": s.MaxMS}
+}
+
+// Summaries returns latency summaries sorted by total duration, so that both a few huge requests
+// and lots of small ones are on top
+func (a *latencyAggregator) Summaries() []latencySummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make([]latencySummary, 0, len(a.entries))
+	for key, entry := range a.entries {
+		result = append(result, latencySummary{
+			Key:      key,
+			Username: key.Username,
+			Verb:     key.Verb,
+			Resource: key.GroupResource(),
+			Count:    entry.sketch.Count(),
+			SumMS:    entry.sketch.Sum(),
+			P50MS:    entry.sketch.Quantile(0.5),
+			P90MS:    entry.sketch.Quantile(0.9),
+			P99MS:    entry.sketch.Quantile(0.99),
+			MaxMS:    entry.sketch.Quantile(1),
+			First:    entry.first,
+			Last:     entry.last,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].SumMS != result[j].SumMS {
+			return result[i].SumMS > result[j].SumMS
+		}
+		return summaryOrder(result[i]) < summaryOrder(result[j])
+	})
+	return result
+}
+
+func summaryOrder(s latencySummary) string {
+	return strings.Join([]string{s.Username, s.Verb, s.Resource}, "\x00")
+}
+
+// Events returns latency summaries as events, quantiles are stored in audit-span/latency-* annotations
+// and decoded into latency_ms.* fields same as apiserver latency annotations
+func (a *latencyAggregator) Events() []auditapi.Event {
+	summaries := a.Summaries()
+	events := make([]auditapi.Event, 0, len(summaries))
+	for _, summary := range summaries {
+		annotations := map[string]string{
+			annotationTypeKey: latencySummaryAnnotation,
+			summaryCountKey:   strconv.FormatUint(summary.Count, 10),
+		}
+		for name, value := range summary.Quantiles() {
+			annotations[summaryLatencyPrefix+name] = time.Duration(value * float64(time.Millisecond)).String()
+		}
+		event := auditapi.Event{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       auditEventKind,
+				APIVersion: auditapi.SchemeGroupVersion.String(),
+			},
+			Level:                    auditapi.LevelNone,
+			Verb:                     summary.Key.Verb,
+			RequestURI:               strings.TrimSpace(fmt.Sprintf("%s %s %s", summary.Key.Username, summary.Key.Verb, summary.Resource)),
+			RequestReceivedTimestamp: metav1.NewMicroTime(summary.First),
+			StageTimestamp:           metav1.NewMicroTime(summary.Last),
+			Annotations:              annotations,
+		}
+		event.User.Username = summary.Key.Username
+		if len(summary.Key.Resource) > 0 {
+			event.ObjectRef = &auditapi.ObjectReference{
+				APIGroup:    summary.Key.APIGroup,
+				APIVersion:  summary.Key.APIVersion,
+				Resource:    summary.Key.Resource,
+				Subresource: summary.Key.Subresource,
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// latencySink adds events to latency aggregator once the sink has acknowledged them,
+// so that events which failed to push are not summarized
+type latencySink struct {
+	Sink
+	latency *latencyAggregator
+	// pending events were written to the sink but not acknowledged yet
+	pending []auditapi.Event
+	counted int
+}
+
+// WriteBatch queues events for sending and aggregates the ones pushed meanwhile
+func (s *latencySink) WriteBatch(events []auditapi.Event) error {
+	s.pending = append(s.pending, events...)
+	return s.aggregateAcknowledged(s.Sink.WriteBatch(events))
+}
+
+func (s *latencySink) Flush() error {
+	return s.aggregateAcknowledged(s.Sink.Flush())
+}
+
+func (s *latencySink) Close() error {
+	return s.aggregateAcknowledged(s.Sink.Close())
+}
+
+// aggregateAcknowledged adds events acknowledged since the last call, sinks acknowledge events in order.
+// Sinks drop the batch which failed to push, so its events are dropped too
+func (s *latencySink) aggregateAcknowledged(err error) error {
+	acked := min(s.Sink.Acknowledged()-s.counted, len(s.pending))
+	s.latency.Add(s.pending[:acked])
+	s.counted += acked
+	s.pending = s.pending[acked:]
+	if err != nil {
+		s.pending = nil
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// parseTestEvents decodes events of testAuditLog
+func parseTestEvents(t *testing.T) []auditapi.Event {
+	t.Helper()
+	events := []auditapi.Event{}
+	for _, line := range strings.Split(strings.TrimSpace(testAuditLog), "\n") {
+		var event auditapi.Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestLatencySummarySentToSink(t *testing.T) {
+	resetRecordedSinks()
+	conf := IngestConfig{
+		SinkName: testSinkName,
+		ProwJob:  "job",
+		Parse:    failOnParseError,
+		Latency:  newLatencyAggregator(),
+	}
+	sinks := newSinkTracker(testLogger())
+	if err := ingestFiles(context.Background(), testLogger(), sinks, conf, []string{writeTestAuditLog(t, testAuditLog)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendLatencySummary(testLogger(), sinks, conf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinks.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	recordedSinks.Lock()
+	defer recordedSinks.Unlock()
+	if len(recordedSinks.sinks) != 2 || recordedSinks.labels[1]["filename"] != latencySummaryStream {
+		t.Fatalf("expected audit log and latency summary streams, got %v", recordedSinks.labels)
+	}
+	summaries := recordedSinks.sinks[1].events
+	if len(summaries) != 2 {
+		t.Fatalf("expected summary per user, verb and resource, got %d", len(summaries))
+	}
+	// Summaries are sorted by total duration
+	top := summaries[0]
+	if top.User.Username != "system:admin" || top.Verb != "list" || top.ObjectRef.Resource != "pods" {
+		t.Errorf("unexpected top summary %v", top)
+	}
+	if top.Annotations[summaryCountKey] != "1" || top.Annotations[annotationTypeKey] != latencySummaryAnnotation {
+		t.Errorf("unexpected summary annotations %v", top.Annotations)
+	}
+
+	record, err := flattenEvent(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"latency_ms.p50", "latency_ms.p99", "latency_ms.max"} {
+		value, ok := record[field].(json.Number)
+		if !ok {
+			t.Errorf("expected numeric %s, got %v", field, record[field])
+			continue
+		}
+		if actual, _ := value.Float64(); actual != 100 {
+			t.Errorf("expected %s to be 100, got %v", field, actual)
+		}
+	}
+	if _, ok := record[durationField]; ok {
+		t.Error("expected summary to have no request duration")
+	}
+}
+
+func TestLatencyAggregatorMerge(t *testing.T) {
+	left, right := newLatencyAggregator(), newLatencyAggregator()
+	events := parseTestEvents(t)
+	left.Add(events[:1])
+	right.Add(events)
+	left.Merge(right)
+	summaries := left.Summaries()
+	if len(summaries) != 2 || summaries[0].Count != 2 || summaries[0].Resource != "v1/pods" {
+		t.Errorf("unexpected merged summaries %v", summaries)
+	}
+}
+
+// bufferingSink acknowledges buffered events on flush unless it fails, failed batch is dropped
+type bufferingSink struct {
+	buffered int
+	acked    int
+	fail     bool
+}
+
+func (s *bufferingSink) WriteBatch(events []auditapi.Event) error {
+	s.buffered += len(events)
+	return nil
+}
+
+func (s *bufferingSink) Flush() error {
+	defer func() { s.buffered = 0 }()
+	if s.fail {
+		return errors.New("push failed")
+	}
+	s.acked += s.buffered
+	return nil
+}
+
+func (s *bufferingSink) Close() error {
+	return s.Flush()
+}
+
+func (s *bufferingSink) Acknowledged() int {
+	return s.acked
+}
+
+func TestLatencySinkAggregatesAcknowledgedEvents(t *testing.T) {
+	events := parseTestEvents(t)
+	inner := &bufferingSink{}
+	latency := newLatencyAggregator()
+	sink := &latencySink{Sink: inner, latency: latency}
+
+	if err := sink.WriteBatch(events[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if summaries := latency.Summaries(); len(summaries) != 0 {
+		t.Fatalf("expected buffered event not to be summarized, got %v", summaries)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	inner.fail = true
+	if err := sink.WriteBatch(events[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err == nil {
+		t.Fatal("expected push error")
+	}
+	summaries := latency.Summaries()
+	if len(summaries) != 1 || summaries[0].Username != events[0].User.Username {
+		t.Errorf("expected only acknowledged event to be summarized, got %v", summaries)
+	}
+}
+
+func TestLatencySummarySkippedForPartialImport(t *testing.T) {
+	state, err := loadImportState(filepath.Join(t.TempDir(), "imports.json"), testSinkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestAuditLog(t, testAuditLog)
+	imp, err := state.Begin("job", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := decodeAuditEvent([]byte(strings.SplitAfter(testAuditLog, "\n")[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imp.Shipped(int64(len(strings.SplitAfter(testAuditLog, "\n")[0])), first); err != nil {
+		t.Fatal(err)
+	}
+
+	resetRecordedSinks()
+	conf := IngestConfig{
+		SinkName: testSinkName,
+		ProwJob:  "job",
+		Parse:    failOnParseError,
+		State:    state,
+		Latency:  newLatencyAggregator(),
+	}
+	sinks := newSinkTracker(testLogger())
+	if err := ingestFiles(context.Background(), testLogger(), sinks, conf, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if !conf.Latency.Partial() {
+		t.Error("expected resumed import to make latency summary partial")
+	}
+	if err := sendLatencySummary(testLogger(), sinks, conf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinks.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	recordedSinks.Lock()
+	defer recordedSinks.Unlock()
+	for _, labels := range recordedSinks.labels {
+		if labels["filename"] == latencySummaryStream {
+			t.Errorf("expected no latency summary of partial import, got %v", recordedSinks.labels)
+		}
+	}
+}
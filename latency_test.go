@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestFlattenEventLatencyFields(t *testing.T) {
+	received := time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC)
+	event := auditapi.Event{
+		AuditID:                  "a1",
+		RequestReceivedTimestamp: metav1.NewMicroTime(received),
+		StageTimestamp:           metav1.NewMicroTime(received.Add(1500 * time.Microsecond)),
+		Annotations: map[string]string{
+			latencyAnnotationPrefix + "etcd":           "1.234567ms",
+			latencyAnnotationPrefix + "total":          "2.5s",
+			latencyAnnotationPrefix + "apf-queue-wait": "250µs",
+			latencyAnnotationPrefix + "broken":         "fast",
+			"authorization.k8s.io/decision":            "allow",
+		},
+	}
+	record, err := flattenEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, expected := range map[string]float64{
+		"latency_ms.etcd":           1.234567,
+		"latency_ms.total":          2500,
+		"latency_ms.apf-queue-wait": 0.25,
+		durationField:               1.5,
+	} {
+		value, ok := record[field].(json.Number)
+		if !ok {
+			t.Errorf("expected numeric %s, got %v", field, record[field])
+			continue
+		}
+		if actual, _ := value.Float64(); actual != expected {
+			t.Errorf("expected %s to be %v, got %v", field, expected, actual)
+		}
+	}
+	if _, ok := record["latency_ms.broken"]; ok {
+		t.Error("expected annotation which is not a duration to be skipped")
+	}
+	if record["annotations.apiserver.latency.k8s.io/etcd"] != "1.234567ms" {
+		t.Errorf("expected raw annotation to be kept, got %v", record["annotations.apiserver.latency.k8s.io/etcd"])
+	}
+}
+
+func TestEventRecordWithoutTimestamps(t *testing.T) {
+	record := newEventRecord(auditapi.Event{AuditID: "a1"})
+	if record.DurationMS != nil || record.LatencyMS != nil {
+		t.Errorf("expected no derived fields, got %v", record)
+	}
+}
@@ -1,74 +1,356 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/afiskon/promtail-client/promtail"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "cache":
+			runCache(os.Args[2:])
+			return
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		}
+	}
+
 	var (
-		lokiAddr    string
-		prowjob     string
-		auditLogDir string
-		debug       bool
+		prowjob        string
+		auditLogDir    string
+		input          string
+		concurrency    int
+		onParseError   string
+		quarantineDir  string
+		follow         bool
+		followInterval time.Duration
+		checkpointFile string
+		stateFile      string
+		force          bool
+		step           string
+		listSteps      bool
+		onlyDuringTest bool
+		cacheDir       string
+		cacheMaxSize   int64
+		noCache        bool
+		cacheStreamed  bool
+		latencySummary bool
+		historyConf    HistoryConfig
 	)
 	logger := setupLogger()
 
-	flag.StringVar(&lokiAddr, "loki-addr", "http://localhost:9428/insert/loki/api/v1/push", "URL to push logs to")
+	sinkOpts := addSinkFlags(flag.CommandLine)
 	flag.StringVar(&prowjob, "prow-job", "", "prowjob URL")
-	flag.StringVar(&auditLogDir, "audit-log-dir", "", "path to dir with audit logs")
-	flag.BoolVar(&debug, "debug", false, "set to true to print sent logs")
+	flag.StringVar(&auditLogDir, "audit-log-dir", "", "path to dir with audit logs, '-' to read from stdin")
+	flag.StringVar(&input, "input", "", "path to audit log file or local or http(s) URL of tar, tar.gz or zip archive with audit logs, '-' to read from stdin")
+	flag.IntVar(&concurrency, "concurrency", 1, "number of audit log files processed simultaneously")
+	flag.StringVar(&onParseError, "on-parse-error", onParseErrorFail, fmt.Sprintf("what to do with malformed audit log lines: %s, %s or %s", onParseErrorFail, onParseErrorSkip, onParseErrorQuarantine))
+	flag.StringVar(&quarantineDir, "quarantine-dir", "", "directory to store malformed lines in quarantine mode, defaults to audit log dir")
+	flag.BoolVar(&follow, "follow", false, "keep reading --input file as it grows, following log rotation")
+	flag.DurationVar(&followInterval, "follow-poll-interval", defaultFollowPollInterval, "how often to check followed file for new data")
+	flag.StringVar(&checkpointFile, "checkpoint-file", defaultCheckpointFile(), "file to store offsets of followed files")
+	flag.StringVar(&historyConf.Job, "prow-job-history", "", "name of the prow job to import recent runs of")
+	flag.IntVar(&historyConf.Last, "last", defaultHistoryRuns, "number of recent runs imported with --prow-job-history")
+	flag.StringVar(&historyConf.Bucket, "gcs-bucket", defaultGCSBucket, "GCS bucket storing prow job runs")
+	flag.StringVar(&step, "step", "", "glob matching step or target/step of the prow job to import audit logs from, '*' for all steps, defaults to the gather step of e2e target")
+	flag.BoolVar(&listSteps, "list-steps", false, "print audit logs tarballs found in the prow job and exit")
+	flag.BoolVar(&onlyDuringTest, "only-during-test", false, "drop events of prow job runs outside of the time between job start and finish")
+	flag.StringVar(&cacheDir, "cache-dir", defaultDownloadCacheDir(), "directory storing downloaded prow job artifacts")
+	flag.Int64Var(&cacheMaxSize, "cache-max-size", defaultCacheMaxSize, "download cache size limit in MB, least recently used artifacts are evicted, 0 for unlimited")
+	flag.BoolVar(&noCache, "no-cache", false, "download prow job artifacts to temp dir instead of the cache")
+	flag.BoolVar(&cacheStreamed, "cache-streamed", false, "keep streamed prow job artifacts in the cache, by default they are streamed without using disk")
+	flag.BoolVar(&historyConf.ExtractToDisk, "extract-to-disk", false, "extract prow job audit logs to temp dir instead of streaming them from tarballs")
+	flag.StringVar(&stateFile, "state-file", defaultImportStateFile(), "file to store progress of imported files")
+	flag.BoolVar(&force, "force", false, "re-import files which were imported already")
+	flag.BoolVar(&latencySummary, "latency-summary", true, "send latency quantiles per user, verb and resource to latency-summary stream once files are imported")
 	flag.Parse()
 
-	prowjobUrl, err := url.Parse(prowjob)
-	if err != nil {
+	if sinkOpts.debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+
+	parseConf := ParseConfig{
+		OnError:       onParseError,
+		QuarantineDir: quarantineDir,
+	}
+	if err := validateParseConfig(parseConf); err != nil {
 		logger.Fatal(err)
 	}
 
-	if len(auditLogDir) == 0 {
+	if listSteps {
+		if err := printProwJobSteps(logger, prowjob); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	if follow && (len(input) == 0 || input == stdinPath || isArchiveInput(input)) {
+		logger.Fatal("--follow requires --input with a path to audit log file")
+	}
+
+	importState, err := loadImportState(stateFile, sinkDestination(sinkOpts.sinkName, sinkOpts.SinkConfig(nil)))
+	if err != nil {
+		logger.Fatalf("failed to load import state %s: %v", stateFile, err)
+	}
+
+	var cache *downloadCache
+	if !noCache {
+		cache, err = openDownloadCache(logger, cacheDir, cacheMaxSize*1024*1024)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		cache.streamed = cacheStreamed
+	}
+	historyConf.Cache = cache
+
+	var (
+		auditLogFiles []string
+		download      *prowJobDownload
+		streamed      *ProwInfo
+	)
+	// Extracted audit logs are removed on exit, downloaded tarballs are kept in the cache
+	cleanup := func() {
+		if download != nil && len(download.Dir) > 0 {
+			os.RemoveAll(download.Dir)
+		}
+	}
+	logrus.RegisterExitHandler(cleanup)
+	switch {
+	case len(historyConf.Job) > 0:
+		// Runs are downloaded one by one while importing
+		historyConf.Step = step
+	case len(input) > 0 && isArchiveInput(input):
+		// Archive members are streamed while importing
+	case len(input) > 0:
+		auditLogFiles = []string{input}
+	case auditLogDir == stdinPath:
+		auditLogFiles = []string{stdinPath}
+	case len(auditLogDir) == 0:
+		prowjobUrl, err := url.Parse(prowjob)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if !historyConf.ExtractToDisk {
+			prowInfo, err := newArtifactLocator(logger).Locate(prowjobUrl)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			streamed = &prowInfo
+			break
+		}
+		prowJobDownload, err := fetchAuditLogsFromProwJob(logger, cache, prowjobUrl, step)
+		download = &prowJobDownload
+		if err != nil {
+			logger.Fatal(err)
+		}
+	default:
 		var err error
-		auditLogDir, err = fetchAuditLogsFromProwJob(logger, prowjobUrl)
+		auditLogFiles, err = findAuditLogsInDir(logger, auditLogDir)
 		if err != nil {
 			logger.Fatal(err)
 		}
 	}
 
-	auditLogFiles, err := findAuditLogsInDir(logger, auditLogDir)
-	if err != nil {
-		logger.Fatal(err)
+	ctx, stop := signalContext(logger)
+	defer stop()
+
+	sinks := newSinkTracker(logger)
+	ingestConf := IngestConfig{
+		SinkName:       sinkOpts.sinkName,
+		Sink:           sinkOpts.SinkConfig(ctx.Done()),
+		ProwJob:        prowjob,
+		Concurrency:    concurrency,
+		Parse:          parseConf,
+		BaseDir:        auditLogDir,
+		OnlyDuringTest: onlyDuringTest,
+		State:          importState,
+		Force:          force,
+	}
+	if latencySummary && !follow {
+		ingestConf.Latency = newLatencyAggregator()
 	}
-	for _, auditLogPath := range auditLogFiles {
-		labels := fmt.Sprintf(`{prowjob="%s", filename="%s"}`, prowjob, auditLogPath)
-		loki, err := prepareLoki(logger, labels, lokiAddr, debug)
+	failed := false
+	// Errors of interrupted imports are expected, others mean that events were lost
+	importFailed := func(err error) {
+		if ctx.Err() != nil {
+			logger.Warning(err)
+		} else {
+			logger.Error(err)
+		}
+		failed = true
+	}
+	if follow {
+		checkpoints, err := loadCheckpoints(checkpointFile)
 		if err != nil {
 			logger.Fatal(err)
 		}
-		if err = parseAuditLogAndSendToOLTP(logger, auditLogPath, loki); err != nil {
+		followConf := FollowConfig{
+			PollInterval: followInterval,
+			Checkpoints:  checkpoints,
+		}
+		if err := followFile(ctx, logger, sinks, ingestConf, followConf, input); err != nil {
+			logger.Error(err)
+			failed = true
+		}
+	} else if len(historyConf.Job) > 0 {
+		if err := importProwJobHistory(ctx, logger, sinks, newArtifactLocator(logger), ingestConf, historyConf); err != nil {
+			importFailed(err)
+		}
+	} else if len(input) > 0 && isArchiveInput(input) {
+		if err := ingestArchive(ctx, logger, sinks, ingestConf, cache, input); err != nil {
+			importFailed(err)
+		}
+		if err := sendLatencySummary(logger, sinks, ingestConf, nil); err != nil {
+			logger.Warning(err)
+		}
+	} else if streamed != nil {
+		if err := streamRun(ctx, logger, sinks, ingestConf, cache, *streamed, step); err != nil {
+			importFailed(err)
+		}
+	} else if download != nil {
+		if err := ingestRun(ctx, logger, sinks, ingestConf, *download, step); err != nil {
+			importFailed(err)
+		}
+	} else {
+		if err := ingestFiles(ctx, logger, sinks, ingestConf, auditLogFiles); err != nil {
+			importFailed(err)
+		}
+		if err := sendLatencySummary(logger, sinks, ingestConf, nil); err != nil {
 			logger.Warning(err)
 		}
 	}
+	if err := sinks.CloseAll(); err != nil {
+		logger.Error(err)
+		failed = true
+	}
+	cleanup()
+	if failed {
+		os.Exit(1)
+	}
 	logger.Info("Done")
 }
 
-func prepareLoki(logger *logrus.Logger, labels, lokiAddr string, debug bool) (promtail.Client, error) {
-	printLevel := promtail.DISABLE
-	if debug {
-		printLevel = promtail.DEBUG
+// printProwJobSteps prints target, step and URL of audit logs tarballs found in the prow job
+func printProwJobSteps(logger *logrus.Logger, prowjob string) error {
+	prowjobUrl, err := url.Parse(prowjob)
+	if err != nil {
+		return err
+	}
+	prowInfo, err := newArtifactLocator(logger).Locate(prowjobUrl)
+	if err != nil {
+		return err
+	}
+	for _, tar := range prowInfo.AuditLogsTars {
+		fmt.Printf("%s\t%s\t%s\n", tar.Target, tar.Step, tar.URL)
+	}
+	return nil
+}
+
+// sinkFlags stores command line flags shared by all commands sending events to sinks
+type sinkFlags struct {
+	sinkName          string
+	lokiAddr          string
+	vlogsAddr         string
+	vlogsStreamFields string
+	vlogsMsgField     string
+	debug             bool
+	maxAttempts       int
+	spoolDir          string
+	maxRequestSize    int
+	pushRateLimit     float64
+}
+
+func addSinkFlags(fs *flag.FlagSet) *sinkFlags {
+	f := &sinkFlags{}
+	fs.StringVar(&f.lokiAddr, "loki-addr", "http://localhost:9428/insert/loki/api/v1/push", "URL to push logs to")
+	fs.StringVar(&f.vlogsAddr, "vlogs-addr", "http://localhost:9428/insert/jsonline", "URL to push logs to when vlogs-jsonline sink is used")
+	fs.StringVar(&f.vlogsStreamFields, "vlogs-stream-fields", "prowjob,target,step,filename", "comma-separated list of VictoriaLogs stream fields")
+	fs.StringVar(&f.vlogsMsgField, "vlogs-msg-field", "requestURI", "audit event field used as VictoriaLogs message")
+	fs.StringVar(&f.sinkName, "sink", sinkLoki, fmt.Sprintf("where to send logs, one of: %s", strings.Join(sinkNames(), ", ")))
+	fs.BoolVar(&f.debug, "debug", false, "set to true to print sent logs")
+	fs.IntVar(&f.maxAttempts, "push-max-attempts", pushMaxAttempts, "number of attempts to push a batch before spooling it to disk")
+	fs.StringVar(&f.spoolDir, "spool-dir", defaultSpoolDir(), "directory to store batches which could not be pushed, empty to disable")
+	fs.IntVar(&f.maxRequestSize, "max-request-size", defaultMaxRequestSize, "maximum size of a single push request in bytes, must not exceed --loki.maxRequestSize of VictoriaLogs")
+	fs.Float64Var(&f.pushRateLimit, "push-rate-limit", 0, "maximum push rate in MB/s shared by all files, 0 for unlimited")
+	return f
+}
+
+// SinkConfig returns sink settings, pushes stop waiting to retry once done is closed
+func (f *sinkFlags) SinkConfig(done <-chan struct{}) SinkConfig {
+	return SinkConfig{
+		Debug:          f.debug,
+		MaxRequestSize: f.maxRequestSize,
+		Push: PushConfig{
+			MaxAttempts: f.maxAttempts,
+			SpoolDir:    f.spoolDir,
+			Limiter:     newByteLimiter(f.pushRateLimit * 1024 * 1024),
+			Done:        done,
+		},
+		LokiAddr:          f.lokiAddr,
+		VlogsAddr:         f.vlogsAddr,
+		VlogsStreamFields: strings.Split(f.vlogsStreamFields, ","),
+		VlogsMsgField:     f.vlogsMsgField,
 	}
-	conf := promtail.ClientConfig{
-		PushURL:            lokiAddr,
-		Labels:             labels,
-		BatchWait:          time.Second,
-		BatchEntriesNumber: 10000,
-		SendLevel:          promtail.DEBUG,
-		PrintLevel:         printLevel,
+}
+
+// signalContext returns context cancelled on SIGINT or SIGTERM
+func signalContext(logger *logrus.Logger) (context.Context, func()) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	stopInterruptHandler := context.AfterFunc(ctx, func() {
+		// Restore default signal handling so that second signal terminates the app
+		stop()
+		logger.Warning("Interrupted, flushing sinks")
+	})
+	return ctx, func() {
+		stopInterruptHandler()
+		stop()
 	}
-	return promtail.NewClientProto(conf, logger)
+}
+
+// runReplay resends batches spooled after failed pushes
+func runReplay(args []string) {
+	var (
+		maxAttempts int
+		spoolDir    string
+	)
+	logger := setupLogger()
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.IntVar(&maxAttempts, "push-max-attempts", pushMaxAttempts, "number of attempts to push a batch")
+	fs.StringVar(&spoolDir, "spool-dir", defaultSpoolDir(), "directory with spooled batches")
+	fs.Parse(args)
+
+	conf := PushConfig{
+		MaxAttempts: maxAttempts,
+		SpoolDir:    spoolDir,
+	}
+	if err := replaySpooledBatches(logger, conf); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("Done")
 }
 
 func setupLogger() *logrus.Logger {
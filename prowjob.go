@@ -21,29 +21,165 @@ import (
 	"github.com/melbahja/got"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/html"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
 )
 
 const (
 	gcsLinkToken        = "gcsweb"
-	gcsPrefix           = "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com"
 	storagePrefix       = "https://storage.googleapis.com"
 	artifactsPath       = "artifacts"
 	promTarPath         = "audit-logs.tar"
 	extraPath           = "gather-audit-logs"
 	hypershiftExtraPath = "hypershift-dump-extra"
 	e2ePrefix           = "e2e"
+	annotationKeyPrefix = "audit-span/"
+	annotationTypeKey   = annotationKeyPrefix + "type"
+	jobWindowAnnotation = "job-window"
 )
 
 // ProwInfo stores all links and data collected via scanning for metrics
 type ProwInfo struct {
-	Started         time.Time
-	Finished        time.Time
+	Job      string
+	BuildID  string
+	Result   string
+	Started  time.Time
+	Finished time.Time
+	// AuditLogsTarURL is the preferred tarball, imported unless the step is selected explicitly
 	AuditLogsTarURL string
+	// AuditLogsTars lists all audit logs tarballs found in the job
+	AuditLogsTars []auditLogsTar
 }
 
-// ProwJSON stores test start / finished timestamp
+// Labels returns stream labels describing the run, empty ones are omitted
+func (p ProwInfo) Labels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range map[string]string{
+		"job":      p.Job,
+		"build_id": p.BuildID,
+		"result":   p.Result,
+	} {
+		if len(v) > 0 {
+			labels[k] = v
+		}
+	}
+	if !p.Started.IsZero() {
+		labels["started"] = p.Started.UTC().Format(time.RFC3339)
+	}
+	if !p.Finished.IsZero() {
+		labels["finished"] = p.Finished.UTC().Format(time.RFC3339)
+	}
+	return labels
+}
+
+// Window returns time range when the job was running
+func (p ProwInfo) Window() timeWindow {
+	return timeWindow{
+		Start: p.Started,
+		End:   p.Finished,
+	}
+}
+
+// AnnotationEvent returns synthetic event at job start, used by Grafana annotations to mark job window.
+// Event message (requestURI) describes the run, job window and result are stored in annotations
+func (p ProwInfo) AnnotationEvent() auditapi.Event {
+	annotations := map[string]string{
+		annotationTypeKey: jobWindowAnnotation,
+	}
+	for k, v := range p.Labels() {
+		annotations[annotationKeyPrefix+k] = v
+	}
+	return auditapi.Event{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       auditEventKind,
+			APIVersion: auditapi.SchemeGroupVersion.String(),
+		},
+		Level:                    auditapi.LevelNone,
+		AuditID:                  types.UID(fmt.Sprintf("%s-%s", p.Job, p.BuildID)),
+		RequestURI:               strings.TrimSpace(fmt.Sprintf("%s #%s %s", p.Job, p.BuildID, p.Result)),
+		RequestReceivedTimestamp: metav1.NewMicroTime(p.Started),
+		StageTimestamp:           metav1.NewMicroTime(p.Started),
+		Annotations:              annotations,
+	}
+}
+
+// auditLogsTar is audit logs tarball collected by a step of the job target
+type auditLogsTar struct {
+	URL    string
+	Target string
+	Step   string
+}
+
+// newAuditLogsTar parses target and step from tarball path, e.g.
+// logs/<job>/<build>/artifacts/<target>/<step>/artifacts/audit-logs.tar
+func newAuditLogsTar(tarURL string) auditLogsTar {
+	tar := auditLogsTar{URL: tarURL}
+	segments := strings.Split(tarURL, "/")
+	for i, segment := range segments {
+		if segment != artifactsPath {
+			continue
+		}
+		if i+1 < len(segments)-1 {
+			tar.Target = segments[i+1]
+		}
+		if i+2 < len(segments)-1 && segments[i+2] != artifactsPath {
+			tar.Step = segments[i+2]
+		}
+		break
+	}
+	return tar
+}
+
+// Labels returns stream labels identifying the tarball, empty ones are omitted
+func (t auditLogsTar) Labels() map[string]string {
+	labels := map[string]string{}
+	if len(t.Target) > 0 {
+		labels["target"] = t.Target
+	}
+	if len(t.Step) > 0 {
+		labels["step"] = t.Step
+	}
+	return labels
+}
+
+// selectAuditLogsTars returns tarballs with step or target/step matching the glob,
+// preferred tarball is returned if glob is empty
+func selectAuditLogsTars(prowInfo ProwInfo, stepGlob string) ([]auditLogsTar, error) {
+	if len(stepGlob) == 0 {
+		return []auditLogsTar{newAuditLogsTar(prowInfo.AuditLogsTarURL)}, nil
+	}
+	result := []auditLogsTar{}
+	available := []string{}
+	for _, tar := range prowInfo.AuditLogsTars {
+		stepMatched, err := path.Match(stepGlob, tar.Step)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step glob %s: %v", stepGlob, err)
+		}
+		targetStepMatched, _ := path.Match(stepGlob, path.Join(tar.Target, tar.Step))
+		if stepMatched || targetStepMatched {
+			result = append(result, tar)
+		}
+		available = append(available, path.Join(tar.Target, tar.Step))
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w matching step %s, available: %s", errNoAuditLogsTar, stepGlob, strings.Join(available, ", "))
+	}
+	return result, nil
+}
+
+// ProwJSON stores test start / finished timestamp and result of finished test
 type ProwJSON struct {
-	Timestamp int `json:"timestamp"`
+	Timestamp int    `json:"timestamp"`
+	Result    string `json:"result"`
+}
+
+// Time returns the timestamp, zero time if it's not set
+func (j ProwJSON) Time() time.Time {
+	if j.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(j.Timestamp), 0)
 }
 
 // getLinksFromURL retrieves links from a given URL by parsing HTML content
@@ -80,48 +216,39 @@ func getLinksFromURL(netClient *http.Client, url string) ([]string, error) {
 	}
 }
 
-// fetchAuditLogsTar retrieves metrics tarball URL from Prow information and constructs the expected metrics URL.
-func fetchAuditLogsTar(logger *logrus.Logger, url *url.URL) (ProwInfo, error) {
-	prowInfo, err := getTarURLFromProw(logger, url)
-	if err != nil {
-		return prowInfo, err
-	}
-	expectedAuditLogsTarURL := prowInfo.AuditLogsTarURL
-
-	// Check that metrics/prometheus.tar can be fetched and it non-null
+// checkAuditLogsTar checks that audit logs tarball can be fetched and is not empty
+func checkAuditLogsTar(expectedAuditLogsTarURL string) error {
 	var netClient = &http.Client{
 		Timeout: time.Second * 10,
 	}
 	resp, err := netClient.Head(expectedAuditLogsTarURL)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch %s: %v", expectedAuditLogsTarURL, err)
+		return fmt.Errorf("failed to fetch %s: %v", expectedAuditLogsTarURL, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: returned %s", expectedAuditLogsTarURL, resp.Status)
+		return fmt.Errorf("failed to check archive at %s: returned %s", expectedAuditLogsTarURL, resp.Status)
 	}
 
 	contentLength := resp.Header.Get("content-length")
 	if contentLength == "" {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: no content length returned", expectedAuditLogsTarURL)
+		return fmt.Errorf("failed to check archive at %s: no content length returned", expectedAuditLogsTarURL)
 	}
 	length, err := strconv.Atoi(contentLength)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: invalid content-length: %v", expectedAuditLogsTarURL, err)
+		return fmt.Errorf("failed to check archive at %s: invalid content-length: %v", expectedAuditLogsTarURL, err)
 	}
 	if length == 0 {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: archive is empty", expectedAuditLogsTarURL)
+		return fmt.Errorf("failed to check archive at %s: archive is empty", expectedAuditLogsTarURL)
 	}
-	return prowInfo, nil
+	return nil
 }
 
-func getTarURLFromProw(logger *logrus.Logger, baseURL *url.URL) (ProwInfo, error) {
+// getTarURLFromProw finds audit logs tarball by walking gcsweb pages linked from Prow job page
+func getTarURLFromProw(logger *logrus.Logger, netClient *http.Client, storageURL string, baseURL *url.URL) (ProwInfo, error) {
 	prowInfo := ProwInfo{}
 
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
-	}
 	// Get a list of links on prow page
 	prowToplinks, err := getLinksFromURL(netClient, baseURL.String())
 	if err != nil {
@@ -133,7 +260,7 @@ func getTarURLFromProw(logger *logrus.Logger, baseURL *url.URL) (ProwInfo, error
 	gcsTempURL := ""
 	for _, link := range prowToplinks {
 		logger.WithFields(logrus.Fields{"link": link})
-		if strings.Contains(link, gcsLinkToken) {
+		if strings.Contains(link, gcsLinkToken) || strings.HasPrefix(link, "/"+gcswebPathPrefix+"/") {
 			gcsTempURL = link
 			break
 		}
@@ -142,23 +269,19 @@ func getTarURLFromProw(logger *logrus.Logger, baseURL *url.URL) (ProwInfo, error
 		return prowInfo, fmt.Errorf("failed to find GCS link in %v", prowToplinks)
 	}
 
-	gcsURL, err := url.Parse(gcsTempURL)
+	gcsURL, err := baseURL.Parse(gcsTempURL)
 	if err != nil {
 		return prowInfo, fmt.Errorf("failed to parse GCS URL %s: %v", gcsTempURL, err)
 	}
+	// Links on gcsweb pages are relative to its host
+	gcsPrefix := fmt.Sprintf("%s://%s", gcsURL.Scheme, gcsURL.Host)
 
 	// Fetch start and finish time of the test
-	startTime, err := getTimeStampFromProwJSON(fmt.Sprintf("%s/started.json", gcsURL))
-	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch test start time: %v", err)
-	}
-	prowInfo.Started = startTime
-
-	finishedTime, err := getTimeStampFromProwJSON(fmt.Sprintf("%s/finished.json", gcsURL))
-	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch test finshed time: %v", err)
+	// Job and build can't be found if gcsweb URL has unexpected format, they are optional
+	location, _ := parseProwJobURL(gcsURL)
+	if err := prowInfo.fetchRunInfo(strings.TrimSuffix(gcsURL.String(), "/"), location); err != nil {
+		return prowInfo, err
 	}
-	prowInfo.Finished = finishedTime
 
 	// Check that 'artifacts' folder is present
 	gcsToplinks, err := getLinksFromURL(netClient, gcsURL.String())
@@ -294,19 +417,21 @@ func getTarURLFromProw(logger *logrus.Logger, baseURL *url.URL) (ProwInfo, error
 	tarFile := promTarPath
 
 	gcsAuditLogURL := fmt.Sprintf("%s%s", e2eURL.String(), tarFile)
-	tempAuditURL := strings.Replace(gcsAuditLogURL, gcsPrefix+"/gcs", storagePrefix, -1)
+	tempAuditURL := strings.Replace(gcsAuditLogURL, gcsPrefix+"/"+gcswebPathPrefix, storageURL, -1)
 	expectedAuditLogURL, err := url.Parse(tempAuditURL)
 	if err != nil {
 		return prowInfo, fmt.Errorf("failed to parse metrics link %s: %v", tempAuditURL, err)
 	}
 	prowInfo.AuditLogsTarURL = expectedAuditLogURL.String()
+	prowInfo.AuditLogsTars = []auditLogsTar{newAuditLogsTar(prowInfo.AuditLogsTarURL)}
 	return prowInfo, nil
 }
 
-func getTimeStampFromProwJSON(rawURL string) (time.Time, error) {
+func getProwJSON(rawURL string) (ProwJSON, error) {
+	var prowInfo ProwJSON
 	jsonURL, err := url.Parse(rawURL)
 	if err != nil {
-		return time.Now(), fmt.Errorf("failed to fetch prow JSOM at %s: %v", rawURL, err)
+		return prowInfo, fmt.Errorf("failed to fetch prow JSOM at %s: %v", rawURL, err)
 	}
 
 	var netClient = &http.Client{
@@ -314,52 +439,125 @@ func getTimeStampFromProwJSON(rawURL string) (time.Time, error) {
 	}
 	resp, err := netClient.Get(jsonURL.String())
 	if err != nil {
-		return time.Now(), fmt.Errorf("failed to fetch %s: %v", jsonURL.String(), err)
+		return prowInfo, fmt.Errorf("failed to fetch %s: %v", jsonURL.String(), err)
 	}
 	defer resp.Body.Close()
 
 	body, readErr := ioutil.ReadAll(resp.Body)
 	if readErr != nil {
-		return time.Now(), fmt.Errorf("failed to read body at %s: %v", jsonURL.String(), err)
+		return prowInfo, fmt.Errorf("failed to read body at %s: %v", jsonURL.String(), err)
 	}
 
-	var prowInfo ProwJSON
 	err = json.Unmarshal(body, &prowInfo)
 	if err != nil {
-		return time.Now(), fmt.Errorf("failed to unmarshal json %s: %v", body, err)
+		return prowInfo, fmt.Errorf("failed to unmarshal json %s: %v", body, err)
 	}
+	return prowInfo, nil
+}
+
+// fetchRunInfo fills job name, build ID, start and finish time and result of the run
+// from started.json and finished.json stored at jobURL
+func (p *ProwInfo) fetchRunInfo(jobURL string, location prowJobLocation) error {
+	started, err := getProwJSON(fmt.Sprintf("%s/started.json", jobURL))
+	if err != nil {
+		return fmt.Errorf("failed to fetch test start time: %v", err)
+	}
+	finished, err := getProwJSON(fmt.Sprintf("%s/finished.json", jobURL))
+	if err != nil {
+		return fmt.Errorf("failed to fetch test finshed time: %v", err)
+	}
+	p.Started = started.Time()
+	p.Finished = finished.Time()
+	p.Result = finished.Result
+	p.Job = location.Job()
+	p.BuildID = location.BuildID()
+	return nil
+}
 
-	return time.Unix(int64(prowInfo.Timestamp), 0), nil
+// prowJobDownload stores audit logs of the job run extracted to Dir
+type prowJobDownload struct {
+	Dir  string
+	Info ProwInfo
+	// FileLabels stores stream labels of each extracted file
+	FileLabels map[string]map[string]string
 }
 
-func fetchAuditLogsFromProwJob(logger *logrus.Logger, prowJobURL *url.URL) (string, error) {
-	tmpDir, err := os.MkdirTemp("", "audit-span")
+// fetchAuditLogsFromProwJob downloads and extracts audit logs tarballs of steps matching the glob
+func fetchAuditLogsFromProwJob(logger *logrus.Logger, cache *downloadCache, prowJobURL *url.URL, stepGlob string) (prowJobDownload, error) {
+	prowjobInfo, err := newArtifactLocator(logger).Locate(prowJobURL)
 	if err != nil {
-		return "", err
+		return prowJobDownload{}, err
 	}
+	return downloadAuditLogs(logger, cache, prowjobInfo, stepGlob)
+}
 
-	prowjobInfo, err := fetchAuditLogsTar(logger, prowJobURL)
+// downloadAuditLogs downloads and extracts audit logs tarballs of the job run selected by step glob.
+// Files are labelled with the run info and the step they were collected by. Tarballs are kept in the cache if it's set
+func downloadAuditLogs(logger *logrus.Logger, cache *downloadCache, prowjobInfo ProwInfo, stepGlob string) (prowJobDownload, error) {
+	download := prowJobDownload{
+		Info:       prowjobInfo,
+		FileLabels: map[string]map[string]string{},
+	}
+	tars, err := selectAuditLogsTars(prowjobInfo, stepGlob)
 	if err != nil {
-		return "", err
+		return download, err
 	}
+	download.Dir, err = os.MkdirTemp("", "audit-span")
+	if err != nil {
+		return download, err
+	}
+
+	for _, tar := range tars {
+		if err := checkAuditLogsTar(tar.URL); err != nil {
+			return download, err
+		}
+		// Steps may collect logs from the same nodes, keep them apart
+		tarDir := filepath.Join(download.Dir, tar.Target, tar.Step)
+		if err := os.MkdirAll(tarDir, 0755); err != nil {
+			return download, err
+		}
+		extractedLogFiles, err := fetchAuditLogsTar(logger, cache, tar.URL, tarDir)
+		if err != nil {
+			return download, err
+		}
+		for _, extractedFile := range extractedLogFiles {
+			labels := prowjobInfo.Labels()
+			for k, v := range tar.Labels() {
+				labels[k] = v
+			}
+			download.FileLabels[extractedFile] = labels
+		}
+	}
+	return download, nil
+}
 
-	auditLogArchiveSplit := strings.Split(prowjobInfo.AuditLogsTarURL, "/")
-	auditLogArchiveFilename := auditLogArchiveSplit[len(auditLogArchiveSplit)-1]
+// fetchAuditLogsTar downloads audit logs tarball to the dir or to the cache if it's set
+// and extracts audit logs from it to the dir
+func fetchAuditLogsTar(logger *logrus.Logger, cache *downloadCache, tarURL string, dir string) ([]string, error) {
+	var auditLogPath string
+	if cache != nil {
+		cachedPath, err := cache.Fetch(tarURL)
+		if err != nil {
+			return nil, err
+		}
+		auditLogPath = cachedPath
+	} else {
+		auditLogArchiveSplit := strings.Split(tarURL, "/")
+		auditLogArchiveFilename := auditLogArchiveSplit[len(auditLogArchiveSplit)-1]
 
-	auditLogPath := filepath.Join(tmpDir, auditLogArchiveFilename)
-	logger.WithFields(logrus.Fields{"url": prowjobInfo.AuditLogsTarURL, "path": auditLogPath}).Info("Downloading audit logs")
+		auditLogPath = filepath.Join(dir, auditLogArchiveFilename)
+		logger.WithFields(logrus.Fields{"url": tarURL, "path": auditLogPath}).Info("Downloading audit logs")
 
-	g := got.New()
-	if err = g.Download(prowjobInfo.AuditLogsTarURL, auditLogPath); err != nil {
-		return "", err
+		g := got.New()
+		if err := g.Download(tarURL, auditLogPath); err != nil {
+			return nil, err
+		}
+		defer os.Remove(auditLogPath)
 	}
 	// Unpack audit tar.gzs from audit-tar
-	extractedArchives, err := untarIt(logger, tmpDir, auditLogPath)
+	extractedArchives, err := untarIt(logger, dir, auditLogPath)
 	if err != nil {
-		return tmpDir, err
-	}
-	if err := os.Remove(auditLogPath); err != nil {
-		return tmpDir, err
+		return nil, err
 	}
 
 	// Ungz each file there too
@@ -375,20 +573,18 @@ func fetchAuditLogsFromProwJob(logger *logrus.Logger, prowJobURL *url.URL) (stri
 			errs = append(errs, err)
 		}
 	}
-	err = errors.Join(errs...)
-	if err != nil {
-		return tmpDir, err
+	if err := errors.Join(errs...); err != nil {
+		return extractedLogFiles, err
 	}
 
-	// List files in tmp dir and extact them all with no filter
-	logger.WithFields(logrus.Fields{"files": len(extractedLogFiles), "dir": tmpDir}).Info("Extracted files")
-	return tmpDir, nil
+	logger.WithFields(logrus.Fields{"files": len(extractedLogFiles), "dir": dir}).Info("Extracted files")
+	return extractedLogFiles, nil
 }
 
 func findAuditLogsInDir(logger *logrus.Logger, auditLogDir string) ([]string, error) {
 	foundFiles := []string{}
 	err := filepath.WalkDir(auditLogDir, func(path string, di fs.DirEntry, err error) error {
-		if !strings.Contains(path, ".log") {
+		if !strings.Contains(path, ".log") || strings.HasSuffix(path, quarantineFileSuffix) {
 			return nil
 		}
 		foundFiles = append(foundFiles, path)
@@ -451,25 +647,20 @@ func untarIt(logger *logrus.Logger, tmpDir string, mpath string) ([]string, erro
 			return result, err
 		}
 		path := hdr.Name
-		if !strings.Contains(path, "-audit") {
+		if !isAuditLogMember(path) {
 			continue
 		}
 
-		splitPath := strings.Split(path, "/")
-		if len(splitPath) < 2 {
+		memberPath := filepath.FromSlash(archiveMemberPath(path))
+		if !filepath.IsLocal(memberPath) {
 			continue
 		}
-		subDirName := splitPath[len(splitPath)-2]
-		subDirPath := filepath.Join(tmpDir, subDirName)
-		_, err = os.Stat(subDirPath)
-		if os.IsNotExist(err) {
-			if err := os.Mkdir(subDirPath, 0755); err != nil {
-				errs = append(errs, err)
-				continue
-			}
+		localPath := filepath.Join(tmpDir, memberPath)
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			errs = append(errs, err)
+			continue
 		}
 
-		localPath := filepath.Join(subDirPath, filepath.Base(path))
 		logger.WithFields(logrus.Fields{"file": path, "destination": localPath}).Infof("Extracting")
 		ow, err := overwrite(localPath)
 		if err != nil {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testJobPath     = "logs/periodic-e2e-aws/1"
+	testTarObject   = testJobPath + "/artifacts/e2e-aws/gather-audit-logs/artifacts/audit-logs.tar"
+	testStartedJSON = `{"timestamp":1726480800}`
+	testFinishJSON  = `{"timestamp":1726484400,"result":"SUCCESS"}`
+)
+
+// newTestGCSServer serves pages under path keys, listing requests are answered by listing handler
+func newTestGCSServer(t *testing.T, pages map[string]string, listing http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, gcsAPIPath+"/") {
+			listing(w, r)
+			return
+		}
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func htmlLinks(links ...string) string {
+	var b strings.Builder
+	b.WriteString("<html><body>")
+	for _, link := range links {
+		fmt.Fprintf(&b, `<a href="%s">%s</a>`, link, link)
+	}
+	b.WriteString("</body></html>")
+	return b.String()
+}
+
+func testLocator(server *httptest.Server) *artifactLocator {
+	locator := newArtifactLocator(testLogger())
+	locator.storageURL = server.URL
+	return locator
+}
+
+func checkProwInfo(t *testing.T, prowInfo ProwInfo, expectedTarURL string) {
+	t.Helper()
+	if prowInfo.AuditLogsTarURL != expectedTarURL {
+		t.Errorf("expected tarball %s, got %s", expectedTarURL, prowInfo.AuditLogsTarURL)
+	}
+	if !prowInfo.Started.Equal(time.Unix(1726480800, 0)) || !prowInfo.Finished.Equal(time.Unix(1726484400, 0)) {
+		t.Errorf("unexpected job timestamps %v - %v", prowInfo.Started, prowInfo.Finished)
+	}
+}
+
+func TestParseProwJobURL(t *testing.T) {
+	for _, rawURL := range []string{
+		"https://prow.ci.openshift.org/view/gs/bucket/" + testJobPath,
+		"https://gcsweb-ci.example.com/gcs/bucket/" + testJobPath + "/",
+	} {
+		u, _ := url.Parse(rawURL)
+		location, err := parseProwJobURL(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.Bucket != "bucket" || location.Path != testJobPath {
+			t.Errorf("unexpected location %+v for %s", location, rawURL)
+		}
+	}
+	u, _ := url.Parse("https://prow.ci.openshift.org/job-history/bucket")
+	if _, err := parseProwJobURL(u); err == nil {
+		t.Error("expected error for URL without bucket")
+	}
+}
+
+func TestLocateViaGCSAPI(t *testing.T) {
+	pages := map[string]string{
+		"/bucket/" + testJobPath + "/started.json":  testStartedJSON,
+		"/bucket/" + testJobPath + "/finished.json": testFinishJSON,
+	}
+	server := newTestGCSServer(t, pages, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != gcsAPIPath+"/b/bucket/o" || r.URL.Query().Get("prefix") != testJobPath+"/" {
+			http.NotFound(w, r)
+			return
+		}
+		// Listing is split in two pages
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprintf(w, `{"items":[{"name":"%s/artifacts/e2e-aws/ipi-install/artifacts/audit-logs.tar","size":"10"}],"nextPageToken":"next"}`, testJobPath)
+			return
+		}
+		fmt.Fprintf(w, `{"items":[{"name":"%s","size":"10"},{"name":"%s/build-log.txt","size":"10"}]}`, testTarObject, testJobPath)
+	})
+
+	u, _ := url.Parse("https://prow.example.com/view/gs/bucket/" + testJobPath)
+	prowInfo, err := testLocator(server).Locate(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProwInfo(t, prowInfo, server.URL+"/bucket/"+testTarObject)
+	if len(prowInfo.AuditLogsTars) != 2 {
+		t.Errorf("expected all tarballs to be listed, got %v", prowInfo.AuditLogsTars)
+	}
+}
+
+func TestLocateFallsBackToScraping(t *testing.T) {
+	gcsJob := "/gcs/bucket/" + testJobPath + "/"
+	pages := map[string]string{
+		"/view/gs/bucket/" + testJobPath:                htmlLinks("/", gcsJob),
+		gcsJob:                                          htmlLinks(gcsJob+"build-log.txt", gcsJob+"artifacts/"),
+		gcsJob + "started.json":                         testStartedJSON,
+		gcsJob + "finished.json":                        testFinishJSON,
+		gcsJob + "artifacts/":                           htmlLinks(gcsJob+"artifacts/build-logs/", gcsJob+"artifacts/e2e-aws/"),
+		gcsJob + "artifacts/e2e-aws/":                   htmlLinks(gcsJob+"artifacts/e2e-aws/gather-audit-logs/", gcsJob+"artifacts/e2e-aws/ipi-install/"),
+		gcsJob + "artifacts/e2e-aws/gather-audit-logs/": htmlLinks(gcsJob + "artifacts/e2e-aws/gather-audit-logs/artifacts/"),
+	}
+	server := newTestGCSServer(t, pages, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+
+	u, _ := url.Parse(server.URL + "/view/gs/bucket/" + testJobPath)
+	prowInfo, err := testLocator(server).Locate(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProwInfo(t, prowInfo, server.URL+"/bucket/"+testTarObject)
+}
+
+func TestLocateDoesNotScrapeWithoutTarball(t *testing.T) {
+	scraped := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, gcsAPIPath+"/") {
+			scraped = true
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"items":[{"name":"%s/build-log.txt","size":"10"}]}`, testJobPath)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/view/gs/bucket/" + testJobPath)
+	if _, err := testLocator(server).Locate(u); !errors.Is(err, errNoAuditLogsTar) {
+		t.Errorf("expected no tarball error, got %v", err)
+	}
+	if scraped {
+		t.Error("expected gcsweb not to be scraped once GCS API listed no tarball")
+	}
+}
+
+func TestSelectAuditLogsTars(t *testing.T) {
+	base := "https://storage.example.com/bucket/" + testJobPath + "/artifacts/"
+	prowInfo := ProwInfo{
+		AuditLogsTarURL: base + "e2e-aws/gather-audit-logs/artifacts/audit-logs.tar",
+		AuditLogsTars: []auditLogsTar{
+			newAuditLogsTar(base + "e2e-aws/gather-audit-logs/artifacts/audit-logs.tar"),
+			newAuditLogsTar(base + "e2e-hypershift/dump-management-cluster/artifacts/audit-logs.tar"),
+			newAuditLogsTar(base + "e2e-hypershift/dump-guest-cluster/artifacts/audit-logs.tar"),
+		},
+	}
+	if tar := prowInfo.AuditLogsTars[1]; tar.Target != "e2e-hypershift" || tar.Step != "dump-management-cluster" {
+		t.Errorf("unexpected target and step of %+v", tar)
+	}
+
+	for glob, expected := range map[string]int{
+		"":                  1,
+		"*":                 3,
+		"dump-*":            2,
+		"e2e-aws/*":         1,
+		"gather-audit-logs": 1,
+	} {
+		tars, err := selectAuditLogsTars(prowInfo, glob)
+		if err != nil {
+			t.Fatalf("glob %q: %v", glob, err)
+		}
+		if len(tars) != expected {
+			t.Errorf("glob %q: expected %d tarballs, got %d", glob, expected, len(tars))
+		}
+	}
+	if _, err := selectAuditLogsTars(prowInfo, "ipi-install"); err == nil {
+		t.Error("expected error when no step matches")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pushRequestTimeout    = time.Minute
+	pushMaxAttempts       = 5
+	pushInitialBackoff    = 500 * time.Millisecond
+	pushMaxBackoff        = 30 * time.Second
+	spoolFileSuffix       = ".batch.json"
+	appCacheDirName       = "audit-log-stats"
+	spoolDirName          = "spool"
+	spoolFilePermissions  = 0644
+	spoolDirPermissions   = 0755
+	responseBodyLogLength = 512
+)
+
+// PushConfig stores retry and spooling settings for pushes to the backend
+type PushConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Directory where batches are stored if all attempts have failed.
+	// Spooling is disabled if empty
+	SpoolDir string
+	// Limiter shared by all pushers, nil for unlimited rate
+	Limiter *byteLimiter
+	// Done stops waiting for the next attempt once closed, e.g. on shutdown. Nil never stops
+	Done <-chan struct{}
+}
+
+// pushRequest is a single batch sent to the backend
+type pushRequest struct {
+	URL         string `json:"url"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+// pushError is returned when backend has responded with unexpected status
+type pushError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *pushError) Error() string {
+	return fmt.Sprintf("returned %s: %s", e.Status, e.Body)
+}
+
+func (e *pushError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// spooledError is returned when the batch was not pushed but stored in spool dir, so it can be replayed
+type spooledError struct {
+	err  error
+	path string
+}
+
+func (e *spooledError) Error() string {
+	return fmt.Sprintf("%v, batch spooled to %s", e.err, e.path)
+}
+
+func (e *spooledError) Unwrap() error {
+	return e.err
+}
+
+// pusher sends batches to the backend, retrying on transient errors
+// and spooling failed batches to disk so that they can be replayed later
+type pusher struct {
+	logger    *logrus.Logger
+	conf      PushConfig
+	netClient *http.Client
+}
+
+func newPusher(logger *logrus.Logger, conf PushConfig) *pusher {
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = pushMaxAttempts
+	}
+	if conf.InitialBackoff <= 0 {
+		conf.InitialBackoff = pushInitialBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = pushMaxBackoff
+	}
+	return &pusher{
+		logger: logger,
+		conf:   conf,
+		netClient: &http.Client{
+			Timeout: pushRequestTimeout,
+		},
+	}
+}
+
+// Push sends the request and spools it to disk if all attempts have failed. Batches rejected by
+// the backend are not spooled, replaying them would fail too
+func (p *pusher) Push(req pushRequest) error {
+	err := p.pushWithRetries(req)
+	if err == nil {
+		return nil
+	}
+	var pushErr *pushError
+	if len(p.conf.SpoolDir) == 0 || (errors.As(err, &pushErr) && !pushErr.retryable()) {
+		return err
+	}
+	spoolPath, spoolErr := spoolBatch(p.conf.SpoolDir, req)
+	if spoolErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to spool batch: %v", spoolErr))
+	}
+	p.logger.WithFields(logrus.Fields{"path": spoolPath}).Warning("Batch spooled, run 'replay' to resend it")
+	return &spooledError{err: err, path: spoolPath}
+}
+
+func (p *pusher) pushWithRetries(req pushRequest) error {
+	backoff := p.conf.InitialBackoff
+	var err error
+	for attempt := 1; attempt <= p.conf.MaxAttempts; attempt++ {
+		err = p.send(req)
+		if err == nil {
+			return nil
+		}
+
+		var pushErr *pushError
+		wait := jitter(backoff)
+		if errors.As(err, &pushErr) {
+			if !pushErr.retryable() {
+				break
+			}
+			if pushErr.RetryAfter > 0 {
+				// Long Retry-After would block shutdown, so it's capped like backoff
+				wait = min(pushErr.RetryAfter, p.conf.MaxBackoff)
+			}
+		}
+		if attempt == p.conf.MaxAttempts {
+			break
+		}
+		p.logger.WithFields(logrus.Fields{"attempt": attempt, "wait": wait, "error": err}).Warning("Push failed, retrying")
+		select {
+		case <-time.After(wait):
+		case <-p.conf.Done:
+			return fmt.Errorf("failed to push to %s, interrupted while retrying: %w", req.URL, err)
+		}
+
+		backoff *= 2
+		if backoff > p.conf.MaxBackoff {
+			backoff = p.conf.MaxBackoff
+		}
+	}
+	return fmt.Errorf("failed to push to %s: %w", req.URL, err)
+}
+
+func (p *pusher) send(req pushRequest) error {
+	p.conf.Limiter.Wait(len(req.Body))
+
+	resp, err := p.netClient.Post(req.URL, req.ContentType, bytes.NewReader(req.Body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	if len(body) > responseBodyLogLength {
+		body = body[:responseBodyLogLength]
+	}
+	return &pushError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// byteLimiter limits number of bytes sent per second
+type byteLimiter struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+	next        time.Time
+}
+
+// newByteLimiter returns nil (unlimited) limiter if rate is not positive
+func newByteLimiter(bytesPerSec float64) *byteLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &byteLimiter{bytesPerSec: bytesPerSec}
+}
+
+// Wait blocks until n bytes can be sent
+func (l *byteLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSec * float64(time.Second)))
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// jitter returns random duration between half and full backoff
+func jitter(backoff time.Duration) time.Duration {
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// parseRetryAfter parses Retry-After header, which is either a number of seconds or HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// defaultCacheDir returns app directory in user cache dir, e.g. ~/.cache/audit-log-stats
+func defaultCacheDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, appCacheDirName)
+}
+
+func defaultSpoolDir() string {
+	return filepath.Join(defaultCacheDir(), spoolDirName)
+}
+
+func spoolBatch(spoolDir string, req pushRequest) (string, error) {
+	if err := os.MkdirAll(spoolDir, spoolDirPermissions); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(spoolDir, fmt.Sprintf("%d-*%s", time.Now().UnixNano(), spoolFileSuffix))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	return f.Name(), f.Chmod(spoolFilePermissions)
+}
+
+func findSpooledBatches(spoolDir string) ([]string, error) {
+	entries, err := os.ReadDir(spoolDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			continue
+		}
+		result = append(result, filepath.Join(spoolDir, entry.Name()))
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// replaySpooledBatches resends spooled batches and removes the ones which were accepted
+func replaySpooledBatches(logger *logrus.Logger, conf PushConfig) error {
+	batches, err := findSpooledBatches(conf.SpoolDir)
+	if err != nil {
+		return err
+	}
+	logger.WithFields(logrus.Fields{"batches": len(batches), "dir": conf.SpoolDir}).Info("Found spooled batches")
+
+	// Don't spool failed batches again, they would be left in place
+	conf.SpoolDir = ""
+	p := newPusher(logger, conf)
+
+	errs := []error{}
+	replayed := 0
+	for _, batchPath := range batches {
+		data, err := os.ReadFile(batchPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var req pushRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse %s: %v", batchPath, err))
+			continue
+		}
+		if err := p.Push(req); err != nil {
+			errs = append(errs, fmt.Errorf("failed to replay %s: %v", batchPath, err))
+			continue
+		}
+		if err := os.Remove(batchPath); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		replayed++
+		logger.WithFields(logrus.Fields{"path": batchPath, "url": req.URL}).Info("Batch replayed")
+	}
+	logger.WithFields(logrus.Fields{"replayed": replayed, "failed": len(batches) - replayed}).Info("Replay finished")
+	return errors.Join(errs...)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPushConfig retries quickly so tests don't wait for real backoff
+func testPushConfig(maxAttempts int) PushConfig {
+	return PushConfig{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+}
+
+// statusServer responds with statuses in order, the last one is repeated
+func statusServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	attempts := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := int(attempts.Add(1))
+		status := statuses[min(attempt, len(statuses))-1]
+		if status != http.StatusNoContent {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}))
+	t.Cleanup(server.Close)
+	return server, attempts
+}
+
+func testPushRequest(url string) pushRequest {
+	return pushRequest{URL: url, ContentType: "application/json", Body: []byte(`{"a":1}`)}
+}
+
+func TestPushRetriesTransientErrors(t *testing.T) {
+	for name, status := range map[string]int{
+		"too many requests":   http.StatusTooManyRequests,
+		"internal error":      http.StatusInternalServerError,
+		"service unavailable": http.StatusServiceUnavailable,
+	} {
+		server, attempts := statusServer(t, nil, status, status, http.StatusNoContent)
+		if err := newPusher(testLogger(), testPushConfig(5)).Push(testPushRequest(server.URL)); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		if attempts.Load() != 3 {
+			t.Errorf("%s: expected 3 attempts, got %d", name, attempts.Load())
+		}
+	}
+}
+
+func TestPushDoesNotRetryClientErrors(t *testing.T) {
+	server, attempts := statusServer(t, nil, http.StatusBadRequest)
+	err := newPusher(testLogger(), testPushConfig(5)).Push(testPushRequest(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "400 Bad Request") {
+		t.Errorf("expected bad request error, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts.Load())
+	}
+}
+
+func TestPushStopsAfterMaxAttempts(t *testing.T) {
+	server, attempts := statusServer(t, nil, http.StatusBadGateway)
+	err := newPusher(testLogger(), testPushConfig(3)).Push(testPushRequest(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "502 Bad Gateway") {
+		t.Errorf("expected bad gateway error, got %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestPushRetriesConnectionErrors(t *testing.T) {
+	attempts := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			// Drop the connection without response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	if err := newPusher(testLogger(), testPushConfig(3)).Push(testPushRequest(server.URL)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestPushWaitsRetryAfter(t *testing.T) {
+	server, attempts := statusServer(t, http.Header{"Retry-After": []string{"1"}}, http.StatusTooManyRequests, http.StatusNoContent)
+	conf := testPushConfig(2)
+	conf.MaxBackoff = 2 * time.Second
+	start := time.Now()
+	if err := newPusher(testLogger(), conf).Push(testPushRequest(server.URL)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait Retry-After of 1s, waited %s", elapsed)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestPushCapsRetryAfter(t *testing.T) {
+	server, attempts := statusServer(t, http.Header{"Retry-After": []string{"3600"}}, http.StatusServiceUnavailable, http.StatusNoContent)
+	start := time.Now()
+	if err := newPusher(testLogger(), testPushConfig(2)).Push(testPushRequest(server.URL)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Retry-After to be capped by max backoff, waited %s", elapsed)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestPushStopsRetryingWhenDone(t *testing.T) {
+	server, attempts := statusServer(t, nil, http.StatusServiceUnavailable)
+	conf := testPushConfig(5)
+	conf.MaxBackoff = time.Hour
+	conf.InitialBackoff = time.Hour
+	conf.SpoolDir = t.TempDir()
+	done := make(chan struct{})
+	close(done)
+	conf.Done = done
+
+	err := newPusher(testLogger(), conf).Push(testPushRequest(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "interrupted while retrying") || !strings.Contains(err.Error(), "batch spooled to") {
+		t.Errorf("expected interrupted push to be spooled, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts.Load())
+	}
+}
+
+func TestPushDoesNotSpoolRejectedBatch(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge} {
+		server, _ := statusServer(t, nil, status)
+		conf := testPushConfig(2)
+		conf.SpoolDir = t.TempDir()
+		err := newPusher(testLogger(), conf).Push(testPushRequest(server.URL))
+		if err == nil || strings.Contains(err.Error(), "spooled") {
+			t.Errorf("%d: expected error without spooling, got %v", status, err)
+		}
+		if batches, err := findSpooledBatches(conf.SpoolDir); err != nil || len(batches) != 0 {
+			t.Errorf("%d: expected no spooled batches, got %v: %v", status, batches, err)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		"0":                             0,
+		"-1":                            0,
+		"soon":                          0,
+		"Wed, 21 Oct 2015 07:28:00 GMT": 0,
+	} {
+		if actual := parseRetryAfter(value); actual != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, actual)
+		}
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if actual := parseRetryAfter(future); actual <= 58*time.Minute || actual > time.Hour {
+		t.Errorf("expected about an hour for %s, got %s", future, actual)
+	}
+}
+
+func TestPushSpoolsFailedBatch(t *testing.T) {
+	server, _ := statusServer(t, nil, http.StatusServiceUnavailable)
+	conf := testPushConfig(2)
+	conf.SpoolDir = t.TempDir()
+	req := testPushRequest(server.URL)
+
+	err := newPusher(testLogger(), conf).Push(req)
+	if err == nil || !strings.Contains(err.Error(), "batch spooled to") {
+		t.Fatalf("expected spooled batch error, got %v", err)
+	}
+	batches, err := findSpooledBatches(conf.SpoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 spooled batch, got %v", batches)
+	}
+	data, err := os.ReadFile(batches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spooled pushRequest
+	if err := json.Unmarshal(data, &spooled); err != nil {
+		t.Fatal(err)
+	}
+	if spooled.URL != req.URL || spooled.ContentType != req.ContentType || string(spooled.Body) != string(req.Body) {
+		t.Errorf("unexpected spooled batch %+v", spooled)
+	}
+}
+
+func TestReplaySpooledBatches(t *testing.T) {
+	accepting, accepted := statusServer(t, nil, http.StatusNoContent)
+	failing, _ := statusServer(t, nil, http.StatusBadRequest)
+	conf := testPushConfig(2)
+	conf.SpoolDir = t.TempDir()
+	for _, url := range []string{accepting.URL, failing.URL, accepting.URL} {
+		if _, err := spoolBatch(conf.SpoolDir, testPushRequest(url)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(conf.SpoolDir, "notes.txt"), []byte("not a batch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := replaySpooledBatches(testLogger(), conf)
+	if err == nil || !strings.Contains(err.Error(), "failed to replay") {
+		t.Errorf("expected replay error of failing batch, got %v", err)
+	}
+	if accepted.Load() != 2 {
+		t.Errorf("expected 2 batches replayed, got %d", accepted.Load())
+	}
+	batches, err := findSpooledBatches(conf.SpoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("expected failed batch to be kept without spooling it again, got %v", batches)
+	}
+	data, err := os.ReadFile(batches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), failing.URL) {
+		t.Errorf("expected failing batch to be kept, got %s", data)
+	}
+	if _, err := os.Stat(filepath.Join(conf.SpoolDir, "notes.txt")); err != nil {
+		t.Errorf("expected unrelated files to be kept: %v", err)
+	}
+}
+
+func TestByteLimiter(t *testing.T) {
+	if limiter := newByteLimiter(0); limiter != nil {
+		t.Fatalf("expected nil limiter for unlimited rate, got %+v", limiter)
+	}
+	// Nil limiter doesn't block
+	var unlimited *byteLimiter
+	unlimited.Wait(1 << 30)
+
+	limiter := newByteLimiter(1000)
+	start := time.Now()
+	for range 3 {
+		limiter.Wait(100)
+	}
+	// First 100 bytes are sent immediately, the rest wait for 100ms each
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected about 200ms wait for 300 bytes at 1000 B/s, waited %s", elapsed)
+	}
+}
+
+func TestByteLimiterIsShared(t *testing.T) {
+	limiter := newByteLimiter(1000)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.Wait(100)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 290*time.Millisecond {
+		t.Errorf("expected concurrent waits to share the rate, waited %s", elapsed)
+	}
+}
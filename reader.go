@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// stdinPath is used instead of file path to read audit log from stdin
+const stdinPath = "-"
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// readCloser combines decompressed reader with a function closing all underlying readers
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// auditLogName returns human-readable name of audit log path
+func auditLogName(path string) string {
+	if path == stdinPath {
+		return "stdin"
+	}
+	return path
+}
+
+// openAuditLog opens audit log file or stdin and decompresses it if needed
+func openAuditLog(path string) (io.ReadCloser, error) {
+	if path == stdinPath {
+		return decompress(os.Stdin)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &readCloser{
+		Reader: reader,
+		close: func() error {
+			reader.Close()
+			return file.Close()
+		},
+	}, nil
+}
+
+// decompress detects compression by magic bytes and returns a reader
+// with decompressed data. Supports gzip, zstd, bzip2 and xz.
+// Closing returned reader doesn't close the source
+func decompress(source io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(source)
+	// Peek returns an error if the stream is shorter than magic, that's fine
+	header, _ := br.Peek(len(xzMagic))
+
+	noop := func() error { return nil }
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return gr, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &readCloser{
+			Reader: zr,
+			close: func() error {
+				zr.Close()
+				return nil
+			},
+		}, nil
+	case bytes.HasPrefix(header, bzip2Magic):
+		return &readCloser{Reader: bzip2.NewReader(br), close: noop}, nil
+	case bytes.HasPrefix(header, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &readCloser{Reader: xr, close: noop}, nil
+	default:
+		return &readCloser{Reader: br, close: noop}, nil
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecompress(t *testing.T) {
+	compressors := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"plain": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"zstd": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		"xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	}
+	for name, newWriter := range compressors {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(testAuditLog)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := decompress(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != testAuditLog {
+				t.Errorf("unexpected decompressed data: %q", data)
+			}
+		})
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	reportFormatTable    = "table"
+	reportFormatMarkdown = "markdown"
+	reportFormatJSON     = "json"
+	defaultReportTop     = 10
+
+	deprecatedAnnotation = "k8s.io/deprecated"
+	unreadyAnnotation    = "openshift.io/unready"
+	unitCount            = "count"
+	unitMS               = "ms"
+	latencySectionTitle  = "Latency per user, verb and resource"
+)
+
+// latencyColumns are columns of latency summary section
+var latencyColumns = []string{"username", "verb", "resource", "count", "sum_ms", "p50_ms", "p90_ms", "p99_ms", "max_ms"}
+
+// mutatingVerbs are counted by "Mutating operations per resource" panel
+var mutatingVerbs = map[string]bool{"create": true, "update": true, "patch": true, "delete": true}
+
+// reportPanel aggregates events the same way as the dashboard panel with the same title
+type reportPanel struct {
+	title  string
+	column string
+	unit   string
+	// add returns aggregation key of the event and the value added to it, false if the event is not aggregated
+	add func(record eventRecord) (string, float64, bool)
+}
+
+// reportPanels mirror panels of grafana/dashboards/dashboard.json
+var reportPanels = []reportPanel{
+	countPanel("Operations per username", "username", completed, eventUsername),
+	countPanel("Operations per resource", "resource", completed, eventResource),
+	countPanel("Operations per verb", "verb", completed, eventVerb),
+	countPanel("Operations per namespace", "namespace", completed, eventNamespace),
+	countPanel("Operations per subresource", "subresource", withSubresource, eventSubresource),
+	countPanel("List operations per resource", "resource", listed, eventResource),
+	countPanel("Mutating operations per resource", "resource", mutating, eventResource),
+	latencyPanel("Slow operations per username", "total"),
+	latencyPanel("Long etcd operations per username", "etcd"),
+	latencyPanel("APF queue wait per username", "apf-queue-wait"),
+	latencyPanel("Large write operations per username", "response-write"),
+	latencyPanel("Long mutating webhook operations per username", "mutating-webhook"),
+	latencyPanel("Decode response object per username", "decode-response-object"),
+	latencyPanel("Transform response object per username", "transform-response-object"),
+	latencyPanel("Serialize response object per username", "serialize-response-object"),
+	countPanel("Deprecated requests per resource", "resource", deprecated, eventResource),
+	countPanel("Deprecated resource requests by user", "username", deprecated, eventUsername),
+	countPanel("Non-loopback unready requests", "resource", unready("loopback=false"), eventResource),
+	countPanel("Loopback requests when kube-apiserver not ready", "username", unready("loopback=true"), eventUsername),
+}
+
+func countPanel(title, column string, filter func(eventRecord) bool, key func(eventRecord) string) reportPanel {
+	return reportPanel{
+		title:  title,
+		column: column,
+		unit:   unitCount,
+		add: func(e eventRecord) (string, float64, bool) {
+			if !filter(e) {
+				return "", 0, false
+			}
+			return key(e), 1, true
+		},
+	}
+}
+
+// latencyPanel sums latency of apiserver.latency.k8s.io/<name> annotation per username
+func latencyPanel(title, name string) reportPanel {
+	return reportPanel{
+		title:  title,
+		column: "username",
+		unit:   unitMS,
+		add: func(e eventRecord) (string, float64, bool) {
+			latency, ok := e.LatencyMS[name]
+			return eventUsername(e), latency, ok
+		},
+	}
+}
+
+func completed(e eventRecord) bool {
+	return e.Stage == auditapi.StageResponseComplete
+}
+
+func withSubresource(e eventRecord) bool {
+	return completed(e) && e.ObjectRef != nil && len(e.ObjectRef.Subresource) > 0
+}
+
+func listed(e eventRecord) bool {
+	return completed(e) && e.Verb == "list"
+}
+
+func mutating(e eventRecord) bool {
+	return completed(e) && mutatingVerbs[e.Verb]
+}
+
+func deprecated(e eventRecord) bool {
+	_, ok := e.Annotations[deprecatedAnnotation]
+	return ok
+}
+
+func unready(value string) func(eventRecord) bool {
+	return func(e eventRecord) bool {
+		return strings.Contains(e.Annotations[unreadyAnnotation], value)
+	}
+}
+
+func eventUsername(e eventRecord) string {
+	return e.User.Username
+}
+
+// eventResource returns group/version/resource of the event, version/resource for the core group
+func eventResource(e eventRecord) string {
+	if e.ObjectRef == nil {
+		return ""
+	}
+	parts := []string{}
+	if len(e.ObjectRef.APIGroup) > 0 {
+		parts = append(parts, e.ObjectRef.APIGroup)
+	}
+	if len(e.ObjectRef.APIVersion) > 0 {
+		parts = append(parts, e.ObjectRef.APIVersion)
+	}
+	return strings.Join(append(parts, e.ObjectRef.Resource), "/")
+}
+
+func eventVerb(e eventRecord) string {
+	return e.Verb
+}
+
+func eventSubresource(e eventRecord) string {
+	return e.ObjectRef.Subresource
+}
+
+func eventNamespace(e eventRecord) string {
+	if e.ObjectRef == nil {
+		return ""
+	}
+	return e.ObjectRef.Namespace
+}
+
+// auditReport aggregates events from all files in memory, it's safe for concurrent use
+type auditReport struct {
+	mu      sync.Mutex
+	events  int
+	values  []map[string]float64
+	latency *latencyAggregator
+}
+
+func newAuditReport() *auditReport {
+	r := &auditReport{
+		values:  make([]map[string]float64, len(reportPanels)),
+		latency: newLatencyAggregator(),
+	}
+	for i := range r.values {
+		r.values[i] = map[string]float64{}
+	}
+	return r
+}
+
+// Add aggregates events, annotations added by audit-span are skipped
+func (r *auditReport) Add(events []auditapi.Event) {
+	r.latency.Add(events)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, event := range events {
+		if _, ok := event.Annotations[annotationTypeKey]; ok {
+			continue
+		}
+		r.events++
+		record := newEventRecord(event)
+		for i, panel := range reportPanels {
+			if key, value, ok := panel.add(record); ok {
+				r.values[i][key] += value
+			}
+		}
+	}
+}
+
+// reportRow is an aggregated value of the panel
+type reportRow struct {
+	Key   string  `json:"key"`
+	Value float64 `json:"value"`
+}
+
+// reportSection is a panel with its top rows
+type reportSection struct {
+	Title  string      `json:"title"`
+	Column string      `json:"column"`
+	Unit   string      `json:"unit"`
+	Rows   []reportRow `json:"rows"`
+}
+
+// reportResult is a summary of all aggregated events
+type reportResult struct {
+	Events   int              `json:"events"`
+	Sections []reportSection  `json:"sections"`
+	Latency  []latencySummary `json:"latency"`
+}
+
+// Result returns top rows of each panel sorted by value and latency summaries with the largest total duration,
+// panels without events are omitted
+func (r *auditReport) Result(top int) reportResult {
+	latency := r.latency.Summaries()
+	if top > 0 && len(latency) > top {
+		latency = latency[:top]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := reportResult{Events: r.events, Sections: []reportSection{}, Latency: latency}
+	for i, panel := range reportPanels {
+		if len(r.values[i]) == 0 {
+			continue
+		}
+		rows := make([]reportRow, 0, len(r.values[i]))
+		for key, value := range r.values[i] {
+			rows = append(rows, reportRow{Key: key, Value: value})
+		}
+		sort.Slice(rows, func(a, b int) bool {
+			if rows[a].Value != rows[b].Value {
+				return rows[a].Value > rows[b].Value
+			}
+			return rows[a].Key < rows[b].Key
+		})
+		if top > 0 && len(rows) > top {
+			rows = rows[:top]
+		}
+		result.Sections = append(result.Sections, reportSection{
+			Title:  panel.title,
+			Column: panel.column,
+			Unit:   panel.unit,
+			Rows:   rows,
+		})
+	}
+	return result
+}
+
+func validateReportFormat(format string) error {
+	switch format {
+	case reportFormatTable, reportFormatMarkdown, reportFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown report format %s, expected %s, %s or %s", format, reportFormatTable, reportFormatMarkdown, reportFormatJSON)
+	}
+}
+
+// writeReport prints report in the format
+func writeReport(w io.Writer, result reportResult, format string) error {
+	if err := validateReportFormat(format); err != nil {
+		return err
+	}
+	switch format {
+	case reportFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case reportFormatMarkdown:
+		fmt.Fprintf(w, "Events: %d\n", result.Events)
+		for _, section := range result.Sections {
+			fmt.Fprintf(w, "\n## %s\n\n", section.Title)
+			fmt.Fprintf(w, "| %s | %s |\n|---|---:|\n", section.Column, section.Unit)
+			for _, row := range section.Rows {
+				fmt.Fprintf(w, "| %s | %s |\n", markdownEscape(reportKey(row.Key)), formatReportValue(row.Value, section.Unit))
+			}
+		}
+		if len(result.Latency) > 0 {
+			fmt.Fprintf(w, "\n## %s\n\n", latencySectionTitle)
+			fmt.Fprintf(w, "| %s |\n|---|---|---|%s\n", strings.Join(latencyColumns, " | "), strings.Repeat("---:|", len(latencyColumns)-3))
+			for _, summary := range result.Latency {
+				cells := latencyCells(summary)
+				for i := range cells {
+					cells[i] = markdownEscape(cells[i])
+				}
+				fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+			}
+		}
+		return nil
+	default:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Events: %d\n", result.Events)
+		for _, section := range result.Sections {
+			fmt.Fprintf(tw, "\n%s\n", section.Title)
+			fmt.Fprintf(tw, "%s\t%s\n", strings.ToUpper(section.Column), strings.ToUpper(section.Unit))
+			for _, row := range section.Rows {
+				fmt.Fprintf(tw, "%s\t%s\n", reportKey(row.Key), formatReportValue(row.Value, section.Unit))
+			}
+		}
+		if len(result.Latency) > 0 {
+			fmt.Fprintf(tw, "\n%s\n", latencySectionTitle)
+			fmt.Fprintf(tw, "%s\n", strings.ToUpper(strings.Join(latencyColumns, "\t")))
+			for _, summary := range result.Latency {
+				fmt.Fprintf(tw, "%s\n", strings.Join(latencyCells(summary), "\t"))
+			}
+		}
+		return tw.Flush()
+	}
+}
+
+// latencyCells returns values of latency summary in the order of latencyColumns
+func latencyCells(s latencySummary) []string {
+	return []string{
+		reportKey(s.Username),
+		reportKey(s.Verb),
+		reportKey(s.Resource),
+		fmt.Sprint(s.Count),
+		formatReportValue(s.SumMS, unitMS),
+		formatReportValue(s.P50MS, unitMS),
+		formatReportValue(s.P90MS, unitMS),
+		formatReportValue(s.P99MS, unitMS),
+		formatReportValue(s.MaxMS, unitMS),
+	}
+}
+
+// reportKey makes empty keys visible, e.g. cluster-scoped requests in namespace panel
+func reportKey(key string) string {
+	if len(key) == 0 {
+		return "<none>"
+	}
+	return key
+}
+
+func formatReportValue(value float64, unit string) string {
+	if unit == unitMS {
+		return fmt.Sprintf("%.3f", value)
+	}
+	return fmt.Sprintf("%.0f", value)
+}
+
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+// runReport aggregates audit logs in memory and prints dashboard panels without sending events anywhere
+func runReport(args []string) {
+	var (
+		source aggregateSource
+		format string
+		top    int
+	)
+	logger := setupLogger()
+
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.StringVar(&source.ProwJob, "prow-job", "", "prowjob URL")
+	fs.StringVar(&source.AuditLogDir, "audit-log-dir", "", "path to dir with audit logs, '-' to read from stdin")
+	fs.StringVar(&source.Input, "input", "", "path to audit log file or local or http(s) URL of tar, tar.gz or zip archive with audit logs, '-' to read from stdin")
+	aggregateOpts := addAggregateFlags(fs)
+	fs.StringVar(&format, "format", reportFormatTable, fmt.Sprintf("output format: %s, %s or %s", reportFormatTable, reportFormatMarkdown, reportFormatJSON))
+	fs.IntVar(&top, "top", defaultReportTop, "number of rows printed per panel, 0 for all")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s report --prow-job|--audit-log-dir|--input <source> [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(source.ProwJob) == 0 && len(source.AuditLogDir) == 0 && len(source.Input) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := validateReportFormat(format); err != nil {
+		logger.Fatal(err)
+	}
+	conf, err := aggregateOpts.AggregateConfig(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	ctx, stop := signalContext(logger)
+	defer stop()
+
+	report := newAuditReport()
+	if _, err := aggregate(ctx, logger, report, conf, source); err != nil {
+		logger.Fatal(err)
+	}
+	if err := writeReport(os.Stdout, report.Result(top), format); err != nil {
+		logger.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// findSection returns report section by title
+func findSection(t *testing.T, result reportResult, title string) reportSection {
+	t.Helper()
+	for _, section := range result.Sections {
+		if section.Title == title {
+			return section
+		}
+	}
+	t.Fatalf("section %s not found in %v", title, result)
+	return reportSection{}
+}
+
+func TestReportFromAuditLog(t *testing.T) {
+	report := newAuditReport()
+	conf := IngestConfig{
+		SinkName: sinkReport,
+		Sink:     SinkConfig{Aggregator: report},
+		Parse:    failOnParseError,
+	}
+	sinks := newSinkTracker(testLogger())
+	if err := ingestFiles(context.Background(), testLogger(), sinks, conf, []string{writeTestAuditLog(t, testAuditLog)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinks.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	result := report.Result(defaultReportTop)
+	if result.Events != 2 {
+		t.Errorf("expected 2 events, got %d", result.Events)
+	}
+	verbs := findSection(t, result, "Operations per verb")
+	if len(verbs.Rows) != 2 || verbs.Rows[0] != (reportRow{Key: "get", Value: 1}) || verbs.Rows[1] != (reportRow{Key: "list", Value: 1}) {
+		t.Errorf("unexpected verbs %v", verbs.Rows)
+	}
+	resources := findSection(t, result, "Operations per resource")
+	if resources.Rows[0].Key != "v1/configmaps" {
+		t.Errorf("unexpected resources %v", resources.Rows)
+	}
+	if len(result.Latency) != 2 || result.Latency[0].Resource != "v1/pods" || result.Latency[0].P99MS != 100 {
+		t.Errorf("unexpected latency summaries %v", result.Latency)
+	}
+	for _, section := range result.Sections {
+		if section.Unit == unitMS {
+			t.Errorf("expected no latency sections without latency annotations, got %s", section.Title)
+		}
+	}
+}
+
+func TestReportLatencyAndTop(t *testing.T) {
+	report := newAuditReport()
+	event := func(user, latency string) auditapi.Event {
+		return auditapi.Event{
+			Stage: auditapi.StageResponseComplete,
+			User:  authnv1.UserInfo{Username: user},
+			Annotations: map[string]string{
+				latencyAnnotationPrefix + "total": latency,
+				deprecatedAnnotation:              "true",
+			},
+		}
+	}
+	report.Add([]auditapi.Event{
+		event("alice", "2s"),
+		event("bob", "1s"),
+		event("alice", "500ms"),
+		// Annotation of prow job window is not a request
+		{Annotations: map[string]string{annotationTypeKey: jobWindowAnnotation}, StageTimestamp: metav1.NowMicro()},
+	})
+
+	result := report.Result(1)
+	if result.Events != 3 {
+		t.Errorf("expected annotation to be skipped, got %d events", result.Events)
+	}
+	slow := findSection(t, result, "Slow operations per username")
+	if len(slow.Rows) != 1 || slow.Rows[0] != (reportRow{Key: "alice", Value: 2500}) {
+		t.Errorf("expected top user alice with 2500ms, got %v", slow.Rows)
+	}
+	deprecated := findSection(t, result, "Deprecated resource requests by user")
+	if deprecated.Rows[0] != (reportRow{Key: "alice", Value: 2}) {
+		t.Errorf("unexpected deprecated requests %v", deprecated.Rows)
+	}
+
+	var out bytes.Buffer
+	if err := writeReport(&out, result, reportFormatMarkdown); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "## Slow operations per username\n\n| username | ms |\n|---|---:|\n| alice | 2500.000 |\n") {
+		t.Errorf("unexpected markdown report:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := writeReport(&out, result, reportFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded reportResult
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Events != 3 || len(decoded.Sections) != len(result.Sections) {
+		t.Errorf("unexpected JSON report %s", out.String())
+	}
+
+	if err := writeReport(&out, result, "csv"); err == nil {
+		t.Error("expected unknown format to fail")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	auditEventListKind     = "EventList"
+	webhookSinkPath        = "webhook"
+	defaultWebhookQueue    = 10000
+	defaultWebhookMaxBody  = 64 * 1024 * 1024
+	webhookShutdownTimeout = 30 * time.Second
+	webhookRetryAfter      = "1"
+)
+
+// auditEventListAnyVersion is a superset of audit.k8s.io/v1 and audit.k8s.io/v1beta1 event lists
+type auditEventListAnyVersion struct {
+	metav1.TypeMeta `json:",inline"`
+	Items           []auditEventAnyVersion `json:"items"`
+}
+
+// auditWebhook receives event lists sent by kube-apiserver audit webhook backend
+// and queues them for sending to the sink
+type auditWebhook struct {
+	logger  *logrus.Logger
+	maxBody int64
+
+	mu     sync.Mutex
+	queue  chan auditapi.Event
+	closed bool
+}
+
+func newAuditWebhook(logger *logrus.Logger, queueSize int, maxBody int64) *auditWebhook {
+	return &auditWebhook{
+		logger:  logger,
+		maxBody: maxBody,
+		queue:   make(chan auditapi.Event, queueSize),
+	}
+}
+
+func (h *auditWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, h.maxBody+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > h.maxBody {
+		http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	events, err := decodeAuditEventList(body)
+	if err != nil {
+		h.logger.WithFields(logrus.Fields{"error": err, "remote": r.RemoteAddr}).Warning("Rejected audit event list")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch err := h.enqueue(events); {
+	case errors.Is(err, errWebhookBatchTooLarge):
+		// Retrying can't help, the list would not fit even into empty queue
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errWebhookQueueFull):
+		// kube-apiserver retries with backoff on 429
+		w.Header().Set("Retry-After", webhookRetryAfter)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+var (
+	errWebhookQueueFull     = errors.New("sink queue is full")
+	errWebhookBatchTooLarge = errors.New("event list is larger than sink queue")
+	errWebhookClosed        = errors.New("server is shutting down")
+)
+
+// enqueue adds all events to the queue or none of them if there is not enough space
+func (h *auditWebhook) enqueue(events []auditapi.Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return errWebhookClosed
+	}
+	if len(events) > cap(h.queue) {
+		return errWebhookBatchTooLarge
+	}
+	if cap(h.queue)-len(h.queue) < len(events) {
+		return errWebhookQueueFull
+	}
+	for _, event := range events {
+		h.queue <- event
+	}
+	return nil
+}
+
+// Close stops accepting new events, queued events are still sent
+func (h *auditWebhook) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+}
+
+// run sends queued events to the sink until webhook is closed
+func (h *auditWebhook) run(sink Sink, flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]auditapi.Event, 0, sinkBatchSize)
+	send := func(flush bool) {
+		if len(batch) > 0 {
+			if err := sink.WriteBatch(batch); err != nil {
+				h.logger.Warning(err)
+			}
+			batch = batch[:0]
+		}
+		if flush {
+			if err := sink.Flush(); err != nil {
+				h.logger.Warning(err)
+			}
+		}
+	}
+	for {
+		select {
+		case event, ok := <-h.queue:
+			if !ok {
+				send(true)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= sinkBatchSize {
+				send(false)
+			}
+		case <-ticker.C:
+			send(true)
+		}
+	}
+}
+
+// decodeAuditEventList decodes audit.k8s.io/v1 or v1beta1 EventList and converts items to v1
+func decodeAuditEventList(data []byte) ([]auditapi.Event, error) {
+	var list auditEventListAnyVersion
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if list.Kind != auditEventListKind {
+		return nil, fmt.Errorf("unsupported kind %s, expected %s", list.Kind, auditEventListKind)
+	}
+
+	events := make([]auditapi.Event, 0, len(list.Items))
+	switch list.APIVersion {
+	case auditapi.SchemeGroupVersion.String():
+		for _, item := range list.Items {
+			events = append(events, item.Event)
+		}
+	case auditV1beta1Group:
+		for _, item := range list.Items {
+			events = append(events, convertV1beta1Event(item))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported apiVersion %s, expected %s or %s", list.APIVersion, auditapi.SchemeGroupVersion.String(), auditV1beta1Group)
+	}
+	return events, nil
+}
+
+// runServe starts HTTP server accepting events from kube-apiserver audit webhook backend
+func runServe(args []string) {
+	var (
+		listenAddr    string
+		webhookPath   string
+		queueSize     int
+		flushInterval time.Duration
+	)
+	logger := setupLogger()
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	sinkOpts := addSinkFlags(fs)
+	fs.StringVar(&listenAddr, "listen", ":8080", "address to listen on")
+	fs.StringVar(&webhookPath, "path", "/audit", "URL path accepting audit event lists")
+	fs.IntVar(&queueSize, "queue-size", defaultWebhookQueue, "number of events queued for sending before responding with 429")
+	fs.DurationVar(&flushInterval, "flush-interval", time.Second, "how often queued events are pushed to the sink")
+	fs.Parse(args)
+
+	if sinkOpts.debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+
+	ctx, stop := signalContext(logger)
+	defer stop()
+
+	sinks := newSinkTracker(logger)
+	sinkConf := sinkOpts.SinkConfig(ctx.Done())
+	sinkConf.Labels = map[string]string{"filename": webhookSinkPath}
+	sink, err := sinks.Open(sinkOpts.sinkName, webhookSinkPath, sinkConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	webhook := newAuditWebhook(logger, queueSize, defaultWebhookMaxBody)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		webhook.run(sink, flushInterval)
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, webhook)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: mux,
+	}
+
+	failed := false
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.WithFields(logrus.Fields{"addr": listenAddr, "path": webhookPath}).Info("Accepting audit events")
+		serverErr <- server.ListenAndServe()
+	}()
+	select {
+	case <-ctx.Done():
+	case err := <-serverErr:
+		logger.Error(err)
+		failed = true
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warning(err)
+	}
+	webhook.Close()
+	<-done
+
+	if err := sinks.CloseAll(); err != nil {
+		logger.Error(err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+	logger.Info("Done")
+}
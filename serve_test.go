@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testEventList = `{"kind":"EventList","apiVersion":"audit.k8s.io/v1","items":[
+{"level":"Metadata","auditID":"a1","stage":"ResponseComplete","requestURI":"/api/v1/pods","verb":"list","user":{"username":"system:admin"},"stageTimestamp":"2024-09-16T10:00:00.100000Z"},
+{"level":"Metadata","auditID":"a2","stage":"ResponseComplete","requestURI":"/api/v1/nodes","verb":"list","user":{"username":"system:admin"},"stageTimestamp":"2024-09-16T10:00:00.200000Z"}]}`
+
+func postEventList(webhook *auditWebhook, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/audit", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	webhook.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuditWebhook(t *testing.T) {
+	webhook := newAuditWebhook(testLogger(), 3, defaultWebhookMaxBody)
+
+	if rec := postEventList(webhook, testEventList); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	// Only one slot left in the queue
+	if rec := postEventList(webhook, testEventList); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 when queue is full, got %d", rec.Code)
+	}
+	if rec := postEventList(webhook, `{"kind":"Event","apiVersion":"audit.k8s.io/v1"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for wrong kind, got %d", rec.Code)
+	}
+
+	sink := &memorySink{}
+	webhook.Close()
+	webhook.run(sink, defaultFollowPollInterval)
+	if len(sink.events) != 2 || sink.events[1].AuditID != "a2" {
+		t.Fatalf("expected 2 queued events to be sent, got %d", len(sink.events))
+	}
+	if rec := postEventList(webhook, testEventList); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after shutdown, got %d", rec.Code)
+	}
+}
+
+func TestAuditWebhookEventListLargerThanQueue(t *testing.T) {
+	webhook := newAuditWebhook(testLogger(), 1, defaultWebhookMaxBody)
+	rec := postEventList(webhook, testEventList)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for event list larger than the queue, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "" {
+		t.Errorf("expected no Retry-After for request which can never succeed")
+	}
+	webhook.Close()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// Sink receives parsed audit events and ships them to the backend
+type Sink interface {
+	// WriteBatch queues events for sending
+	WriteBatch(events []auditapi.Event) error
+	// Flush sends all queued events
+	Flush() error
+	// Close flushes remaining events and releases sink resources
+	Close() error
+	// Acknowledged returns number of events accepted by the backend
+	Acknowledged() int
+}
+
+// SinkConfig stores settings for all known sinks
+type SinkConfig struct {
+	// Labels attached to every event sent via this sink
+	Labels map[string]string
+	Debug  bool
+	Push   PushConfig
+	// Batch is pushed once it reaches this size in bytes
+	MaxRequestSize int
+
+	LokiAddr string
+
+	VlogsAddr         string
+	VlogsStreamFields []string
+	VlogsMsgField     string
+
+	// Aggregator collects events in memory instead of sending them to a registered sink,
+	// used by commands aggregating events only
+	Aggregator eventAggregator
+}
+
+// 32Mb is half of default --loki.maxRequestSize of VictoriaLogs, leaving room for protobuf framing of entries
+const defaultMaxRequestSize = 32 * 1024 * 1024
+
+// sinkDestination identifies where the sink sends events, e.g. loki+http://localhost:9428/insert/loki/api/v1/push
+func sinkDestination(name string, conf SinkConfig) string {
+	switch name {
+	case sinkLoki:
+		return name + "+" + conf.LokiAddr
+	case sinkVlogsJSONLine:
+		return name + "+" + conf.VlogsAddr
+	default:
+		return name
+	}
+}
+
+// sinkFactory creates a new sink from config
+type sinkFactory func(logger *logrus.Logger, conf SinkConfig) (Sink, error)
+
+var sinkRegistry = map[string]sinkFactory{}
+
+// registerSink makes sink available for selection via --sink flag
+func registerSink(name string, factory sinkFactory) {
+	if _, exists := sinkRegistry[name]; exists {
+		panic(fmt.Sprintf("sink %s is already registered", name))
+	}
+	sinkRegistry[name] = factory
+}
+
+func newSink(logger *logrus.Logger, name string, conf SinkConfig) (Sink, error) {
+	// Events aggregated in memory are not sent anywhere, so the sink is not registered
+	if conf.Aggregator != nil {
+		return newReportSink(conf.Aggregator), nil
+	}
+	factory, ok := sinkRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %s, available sinks: %s", name, strings.Join(sinkNames(), ", "))
+	}
+	return factory(logger, conf)
+}
+
+func sinkNames() []string {
+	names := make([]string, 0, len(sinkRegistry))
+	for name := range sinkRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sinkTracker keeps track of all opened sinks so that none of them
+// is left unflushed when the app exits
+type sinkTracker struct {
+	logger *logrus.Logger
+	mu     sync.Mutex
+	// sinks are open sinks, they are moved to closed before closing
+	sinks  map[string]Sink
+	closed map[string]Sink
+	order  []string
+	// closing counts sinks being closed, summary waits for them
+	closing sync.WaitGroup
+}
+
+func newSinkTracker(logger *logrus.Logger) *sinkTracker {
+	return &sinkTracker{
+		logger: logger,
+		sinks:  map[string]Sink{},
+		closed: map[string]Sink{},
+	}
+}
+
+// Open creates a new sink for the file
+func (t *sinkTracker) Open(name, path string, conf SinkConfig) (Sink, error) {
+	sink, err := newSink(t.logger, name, conf)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, open := t.sinks[path]
+	_, closed := t.closed[path]
+	if !open && !closed {
+		t.order = append(t.order, path)
+	}
+	t.sinks[path] = sink
+	delete(t.closed, path)
+	return sink, nil
+}
+
+// Close flushes and closes the sink opened for the file. The lock is not held while flushing,
+// so slow pushes don't block other files
+func (t *sinkTracker) Close(path string) error {
+	sink, ok := t.take(path)
+	if !ok {
+		return nil
+	}
+	defer t.closing.Done()
+	return closeSink(path, sink)
+}
+
+// take moves the sink from open to closed ones
+func (t *sinkTracker) take(path string) (Sink, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sink, ok := t.sinks[path]
+	if !ok {
+		return nil, false
+	}
+	delete(t.sinks, path)
+	t.closed[path] = sink
+	t.closing.Add(1)
+	return sink, true
+}
+
+func closeSink(path string, sink Sink) error {
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("failed to close sink for %s: %v", path, err)
+	}
+	return nil
+}
+
+// CloseAll closes all sinks which are still open in parallel and prints a summary
+// of acknowledged events per file
+func (t *sinkTracker) CloseAll() error {
+	t.mu.Lock()
+	paths := []string{}
+	open := []Sink{}
+	for _, path := range t.order {
+		if sink, ok := t.sinks[path]; ok {
+			paths = append(paths, path)
+			open = append(open, sink)
+			t.closed[path] = sink
+		}
+	}
+	t.sinks = map[string]Sink{}
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(open))
+	for i, sink := range open {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = closeSink(paths[i], sink)
+		}()
+	}
+	wg.Wait()
+	// Sinks closed by other goroutines must be done before reading acknowledgements
+	t.closing.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := 0
+	for _, path := range t.order {
+		sink, ok := t.closed[path]
+		if !ok {
+			// Opened again while other sinks were closing
+			continue
+		}
+		acked := sink.Acknowledged()
+		total += acked
+		t.logger.WithFields(logrus.Fields{"path": path, "acknowledged": acked}).Info("Events acknowledged")
+	}
+	t.logger.WithFields(logrus.Fields{"files": len(t.order), "acknowledged": total}).Info("Total events acknowledged")
+	return errors.Join(errs...)
+}
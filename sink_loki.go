@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/afiskon/promtail-client/logproto"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	sinkLoki         = "loki"
+	lokiBatchEntries = 10000
+)
+
+func init() {
+	registerSink(sinkLoki, newLokiSink)
+}
+
+// lokiSink sends audit events as JSON lines via Loki protobuf push API
+type lokiSink struct {
+	logger  *logrus.Logger
+	pushURL string
+	labels  string
+	debug   bool
+	pusher  *pusher
+	maxSize int
+	batch   []*logproto.Entry
+	size    int
+	acked   int
+}
+
+func newLokiSink(logger *logrus.Logger, conf SinkConfig) (Sink, error) {
+	return &lokiSink{
+		logger:  logger,
+		pushURL: conf.LokiAddr,
+		labels:  lokiLabels(conf.Labels),
+		debug:   conf.Debug,
+		pusher:  newPusher(logger, conf.Push),
+		maxSize: conf.MaxRequestSize,
+	}, nil
+}
+
+func (s *lokiSink) WriteBatch(events []auditapi.Event) error {
+	for _, event := range events {
+		entry, err := lokiEntry(event)
+		if err != nil {
+			return err
+		}
+		if s.debug {
+			s.logger.Debug(entry.Line)
+		}
+		// Flush before the entry overflows the request, an entry larger than the limit is sent alone
+		if s.maxSize > 0 && len(s.batch) > 0 && s.size+len(entry.Line) > s.maxSize {
+			if err := s.Flush(); err != nil {
+				return err
+			}
+		}
+		s.batch = append(s.batch, entry)
+		s.size += len(entry.Line)
+		if len(s.batch) >= lokiBatchEntries || (s.maxSize > 0 && s.size >= s.maxSize) {
+			if err := s.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush pushes current batch to Loki and waits for the response
+func (s *lokiSink) Flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	defer func() {
+		s.batch = nil
+		s.size = 0
+	}()
+
+	if err := s.push(s.batch); err != nil {
+		return err
+	}
+	s.acked += len(s.batch)
+	return nil
+}
+
+func (s *lokiSink) Close() error {
+	return s.Flush()
+}
+
+func (s *lokiSink) Acknowledged() int {
+	return s.acked
+}
+
+func (s *lokiSink) push(entries []*logproto.Entry) error {
+	req := logproto.PushRequest{
+		Streams: []*logproto.Stream{
+			{
+				Labels:  s.labels,
+				Entries: entries,
+			},
+		},
+	}
+	buf, err := proto.Marshal(&req)
+	if err != nil {
+		return fmt.Errorf("unable to marshal push request: %v", err)
+	}
+	buf = snappy.Encode(nil, buf)
+
+	err = s.pusher.Push(pushRequest{
+		URL:         s.pushURL,
+		ContentType: "application/x-protobuf",
+		Body:        buf,
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.WithFields(logrus.Fields{"events": len(entries)}).Debug("Pushed events to Loki")
+	return nil
+}
+
+func lokiEntry(event auditapi.Event) (*logproto.Entry, error) {
+	eventJson, err := json.Marshal(newEventRecord(event))
+	if err != nil {
+		return nil, err
+	}
+	stamp := event.StageTimestamp.UnixNano()
+	return &logproto.Entry{
+		Timestamp: &timestamp.Timestamp{
+			Seconds: stamp / int64(time.Second),
+			Nanos:   int32(stamp % int64(time.Second)),
+		},
+		Line: string(eventJson),
+	}, nil
+}
+
+// lokiLabels formats labels as Loki stream selector. Values are quoted with escaping,
+// invalid characters in names are replaced with underscores
+func lokiLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, lokiLabelName(k)+"="+strconv.Quote(labels[k]))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ", "))
+}
+
+// lokiLabelName makes label name match [a-zA-Z_][a-zA-Z0-9_]*
+func lokiLabelName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
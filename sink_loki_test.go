@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/afiskon/promtail-client/logproto"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestLokiSinkMaxRequestSize(t *testing.T) {
+	server, requests := recordingServer(t)
+	event := auditapi.Event{Verb: "get", RequestURI: "/api/v1/pods"}
+	entry, err := lokiEntry(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two and a half entries fit into a request
+	maxSize := len(entry.Line) * 5 / 2
+	sink, err := newLokiSink(testLogger(), SinkConfig{LokiAddr: server.URL, MaxRequestSize: maxSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteBatch([]auditapi.Event{event, event, event, event, event}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	received := requests()
+	if len(received) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(received))
+	}
+	total := 0
+	for _, req := range received {
+		decoded, err := snappy.Decode(nil, req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var push logproto.PushRequest
+		if err := proto.Unmarshal(decoded, &push); err != nil {
+			t.Fatal(err)
+		}
+		size := 0
+		for _, stream := range push.Streams {
+			for _, entry := range stream.Entries {
+				size += len(entry.Line)
+				total++
+			}
+		}
+		if size > maxSize {
+			t.Errorf("request with %d bytes of entries exceeds limit of %d", size, maxSize)
+		}
+	}
+	if total != 5 || sink.Acknowledged() != 5 {
+		t.Errorf("expected 5 events sent and acknowledged, got %d and %d", total, sink.Acknowledged())
+	}
+}
+
+func TestLokiSinkSendsOversizedEntryAlone(t *testing.T) {
+	server, requests := recordingServer(t)
+	sink, err := newLokiSink(testLogger(), SinkConfig{LokiAddr: server.URL, MaxRequestSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteBatch([]auditapi.Event{{Verb: "get"}, {Verb: "list"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests()) != 2 || sink.Acknowledged() != 2 {
+		t.Errorf("expected each entry in its own request, got %d requests", len(requests()))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// sinkReport names the sink of commands aggregating events in memory, it's not selectable with --sink
+const sinkReport = "report"
+
+// reportSink adds events to in-memory aggregator instead of sending them to a backend
+type reportSink struct {
+	aggregator eventAggregator
+	acked      int
+}
+
+func newReportSink(aggregator eventAggregator) Sink {
+	return &reportSink{aggregator: aggregator}
+}
+
+// WriteBatch aggregates events
+func (s *reportSink) WriteBatch(events []auditapi.Event) error {
+	s.aggregator.Add(events)
+	s.acked += len(events)
+	return nil
+}
+
+// Flush does nothing, events are aggregated as they are written
+func (s *reportSink) Flush() error {
+	return nil
+}
+
+// Close does nothing, report is printed once all files are processed
+func (s *reportSink) Close() error {
+	return nil
+}
+
+// Acknowledged returns number of aggregated events
+func (s *reportSink) Acknowledged() int {
+	return s.acked
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const testAuditLog = `{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Metadata","auditID":"a1","stage":"ResponseComplete","requestURI":"/api/v1/pods","verb":"list","user":{"username":"system:admin"},"objectRef":{"resource":"pods","apiVersion":"v1"},"requestReceivedTimestamp":"2024-09-16T10:00:00.000000Z","stageTimestamp":"2024-09-16T10:00:00.100000Z"}
+{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Metadata","auditID":"a2","stage":"ResponseComplete","requestURI":"/api/v1/namespaces/default/configmaps/foo","verb":"get","user":{"username":"system:serviceaccount:default:foo"},"objectRef":{"resource":"configmaps","namespace":"default","name":"foo","apiVersion":"v1"},"requestReceivedTimestamp":"2024-09-16T10:00:01.000000Z","stageTimestamp":"2024-09-16T10:00:01.020000Z"}
+`
+
+var failOnParseError = ParseConfig{OnError: onParseErrorFail}
+
+// memorySink stores all events in memory so tests can check what was sent
+type memorySink struct {
+	events  []auditapi.Event
+	flushes int
+	closed  bool
+}
+
+func (s *memorySink) WriteBatch(events []auditapi.Event) error {
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *memorySink) Flush() error {
+	s.flushes++
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *memorySink) Acknowledged() int {
+	return len(s.events)
+}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func writeTestAuditLog(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseAuditLogAndSendToSink(t *testing.T) {
+	path := writeTestAuditLog(t, testAuditLog)
+	sink := &memorySink{}
+
+	if _, err := parseAuditLogAndSendToOLTP(context.Background(), testLogger(), path, sink, failOnParseError, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sink.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(sink.events))
+	}
+	if sink.events[0].AuditID != "a1" || sink.events[1].AuditID != "a2" {
+		t.Errorf("unexpected events order: %s, %s", sink.events[0].AuditID, sink.events[1].AuditID)
+	}
+	if sink.events[1].ObjectRef.Namespace != "default" {
+		t.Errorf("expected namespace default, got %s", sink.events[1].ObjectRef.Namespace)
+	}
+	if sink.flushes != 1 {
+		t.Errorf("expected sink to be flushed once, got %d", sink.flushes)
+	}
+}
+
+func TestNewSinkUnknown(t *testing.T) {
+	if _, err := newSink(testLogger(), "nonexistent", SinkConfig{}); err == nil {
+		t.Fatal("expected error for unknown sink")
+	}
+}
+
+func TestSinkTrackerDoesNotBlockOnSlowClose(t *testing.T) {
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	waitPush := func() {
+		t.Helper()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("push was not received")
+		}
+	}
+	tracker := newSinkTracker(testLogger())
+	conf := SinkConfig{LokiAddr: server.URL, Push: PushConfig{MaxAttempts: 1}}
+	open := func(path string) {
+		t.Helper()
+		sink, err := tracker.Open(sinkLoki, path, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.WriteBatch([]auditapi.Event{{Verb: "get"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open("a")
+	closed := make(chan error, 1)
+	go func() { closed <- tracker.Close("a") }()
+	waitPush()
+
+	// Flush of a is in progress, other files must still be opened and closed in parallel
+	opened := make(chan struct{})
+	go func() {
+		open("b")
+		open("c")
+		close(opened)
+	}()
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open is blocked by Close of other sink")
+	}
+	closedAll := make(chan error, 1)
+	go func() { closedAll <- tracker.CloseAll() }()
+	waitPush()
+	waitPush()
+
+	release <- struct{}{}
+	release <- struct{}{}
+	release <- struct{}{}
+	for _, ch := range []chan error{closed, closedAll} {
+		if err := <-ch; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"a", "b", "c"} {
+		if acked := tracker.closed[path].Acknowledged(); acked != 1 {
+			t.Errorf("expected 1 event acknowledged for %s, got %d", path, acked)
+		}
+	}
+}
+
+func TestReportSinkIsNotSelectable(t *testing.T) {
+	for _, name := range sinkNames() {
+		if name == sinkReport {
+			t.Errorf("expected report sink not to be listed in %v", sinkNames())
+		}
+	}
+	if _, err := newSink(testLogger(), sinkReport, SinkConfig{}); err == nil {
+		t.Error("expected report sink not to be available without aggregator")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	sinkVlogsJSONLine = "vlogs-jsonline"
+	vlogsTimeField    = "_time"
+	vlogsFieldSep     = "."
+	vlogsBatchEntries = 10000
+)
+
+func init() {
+	registerSink(sinkVlogsJSONLine, newVlogsSink)
+}
+
+// VlogsConfig stores settings for VictoriaLogs /insert/jsonline endpoint
+type VlogsConfig struct {
+	// E.g. http://localhost:9428/insert/jsonline
+	PushURL string
+	// Fields used to build log stream, e.g. prowjob,filename
+	StreamFields []string
+	// Field used as a log message, e.g. requestURI
+	MsgField string
+	// Extra fields attached to every event
+	Labels             map[string]string
+	BatchEntriesNumber int
+	MaxRequestSize     int
+	Push               PushConfig
+}
+
+// vlogsSink sends flattened audit events to VictoriaLogs as JSON lines
+type vlogsSink struct {
+	config    VlogsConfig
+	logger    *logrus.Logger
+	pusher    *pusher
+	pushURL   string
+	batch     bytes.Buffer
+	batchSize int
+	acked     int
+}
+
+func newVlogsSink(logger *logrus.Logger, conf SinkConfig) (Sink, error) {
+	return newVlogsClient(logger, VlogsConfig{
+		PushURL:            conf.VlogsAddr,
+		StreamFields:       conf.VlogsStreamFields,
+		MsgField:           conf.VlogsMsgField,
+		Labels:             conf.Labels,
+		BatchEntriesNumber: vlogsBatchEntries,
+		MaxRequestSize:     conf.MaxRequestSize,
+		Push:               conf.Push,
+	})
+}
+
+func newVlogsClient(logger *logrus.Logger, conf VlogsConfig) (*vlogsSink, error) {
+	pushURL, err := url.Parse(conf.PushURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse VictoriaLogs URL %s: %v", conf.PushURL, err)
+	}
+	query := pushURL.Query()
+	query.Set("_time_field", vlogsTimeField)
+	if len(conf.StreamFields) > 0 {
+		query.Set("_stream_fields", strings.Join(conf.StreamFields, ","))
+	}
+	if len(conf.MsgField) > 0 {
+		query.Set("_msg_field", conf.MsgField)
+	}
+	pushURL.RawQuery = query.Encode()
+
+	if conf.BatchEntriesNumber <= 0 {
+		conf.BatchEntriesNumber = vlogsBatchEntries
+	}
+	return &vlogsSink{
+		config:  conf,
+		logger:  logger,
+		pusher:  newPusher(logger, conf.Push),
+		pushURL: pushURL.String(),
+	}, nil
+}
+
+// WriteBatch adds events to the current batch and pushes the batch when it is full
+func (c *vlogsSink) WriteBatch(events []auditapi.Event) error {
+	for _, event := range events {
+		if err := c.write(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *vlogsSink) write(event auditapi.Event) error {
+	record, err := flattenEvent(event)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.config.Labels {
+		record[k] = v
+	}
+	record[vlogsTimeField] = event.StageTimestamp.UTC().Format(time.RFC3339Nano)
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// Flush before the line overflows the request, a line larger than the limit is sent alone
+	if c.config.MaxRequestSize > 0 && c.batchSize > 0 && c.batch.Len()+len(line)+1 > c.config.MaxRequestSize {
+		if err := c.Flush(); err != nil {
+			return err
+		}
+	}
+	c.batch.Write(line)
+	c.batch.WriteByte('\n')
+	c.batchSize++
+
+	if c.batchSize >= c.config.BatchEntriesNumber || (c.config.MaxRequestSize > 0 && c.batch.Len() >= c.config.MaxRequestSize) {
+		return c.Flush()
+	}
+	return nil
+}
+
+// Close pushes remaining events
+func (c *vlogsSink) Close() error {
+	return c.Flush()
+}
+
+// Flush pushes current batch to VictoriaLogs
+func (c *vlogsSink) Flush() error {
+	if c.batchSize == 0 {
+		return nil
+	}
+	defer func() {
+		c.batch.Reset()
+		c.batchSize = 0
+	}()
+
+	err := c.pusher.Push(pushRequest{
+		URL:         c.pushURL,
+		ContentType: "application/stream+json",
+		Body:        c.batch.Bytes(),
+	})
+	if err != nil {
+		return err
+	}
+	c.acked += c.batchSize
+	c.logger.WithFields(logrus.Fields{"events": c.batchSize}).Debug("Pushed events to VictoriaLogs")
+	return nil
+}
+
+func (c *vlogsSink) Acknowledged() int {
+	return c.acked
+}
+
+// flattenEvent converts audit event with derived fields to a flat map with dot-separated keys,
+// the same way VictoriaLogs names fields of nested JSON objects
+func flattenEvent(event auditapi.Event) (map[string]interface{}, error) {
+	eventJson, err := json.Marshal(newEventRecord(event))
+	if err != nil {
+		return nil, err
+	}
+	var nested map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(eventJson))
+	decoder.UseNumber()
+	if err := decoder.Decode(&nested); err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{}
+	if err := flattenInto(result, "", nested); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func flattenInto(result map[string]interface{}, prefix string, value map[string]interface{}) error {
+	for k, v := range value {
+		key := k
+		if len(prefix) > 0 {
+			key = prefix + vlogsFieldSep + k
+		}
+		switch typed := v.(type) {
+		case map[string]interface{}:
+			if err := flattenInto(result, key, typed); err != nil {
+				return err
+			}
+		case []interface{}:
+			// VictoriaLogs stores arrays as JSON strings
+			encoded, err := json.Marshal(typed)
+			if err != nil {
+				return err
+			}
+			result[key] = string(encoded)
+		default:
+			result[key] = typed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditapi "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// recordedRequest is a request received by the test backend
+type recordedRequest struct {
+	Path        string
+	Query       map[string]string
+	ContentType string
+	Body        []byte
+}
+
+// recordingServer accepts all requests and records them
+func recordingServer(t *testing.T) (*httptest.Server, func() []recordedRequest) {
+	t.Helper()
+	var (
+		mu       sync.Mutex
+		requests []recordedRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := map[string]string{}
+		for k := range r.URL.Query() {
+			query[k] = r.URL.Query().Get(k)
+		}
+		mu.Lock()
+		requests = append(requests, recordedRequest{Path: r.URL.Path, Query: query, ContentType: r.Header.Get("Content-Type"), Body: body})
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []recordedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]recordedRequest{}, requests...)
+	}
+}
+
+func TestVlogsSinkRequest(t *testing.T) {
+	server, requests := recordingServer(t)
+	sink, err := newVlogsClient(testLogger(), VlogsConfig{
+		PushURL:      server.URL + "/insert/jsonline",
+		StreamFields: []string{"prowjob", "filename"},
+		MsgField:     "requestURI",
+		Labels:       map[string]string{"prowjob": "job-1", "filename": "audit.log"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stageTimestamp := time.Date(2024, 9, 16, 10, 0, 0, 100000000, time.UTC)
+	event := auditapi.Event{
+		Stage:          auditapi.StageResponseComplete,
+		RequestURI:     "/api/v1/pods",
+		Verb:           "list",
+		User:           authnv1.UserInfo{Username: "system:admin"},
+		ObjectRef:      &auditapi.ObjectReference{Resource: "pods", APIVersion: "v1"},
+		StageTimestamp: metav1.NewMicroTime(stageTimestamp),
+	}
+	if err := sink.WriteBatch([]auditapi.Event{event, event}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sink.Acknowledged() != 2 {
+		t.Errorf("expected 2 acknowledged events, got %d", sink.Acknowledged())
+	}
+
+	received := requests()
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	req := received[0]
+	if req.Path != "/insert/jsonline" {
+		t.Errorf("unexpected path %s", req.Path)
+	}
+	for param, expected := range map[string]string{
+		"_time_field":    vlogsTimeField,
+		"_stream_fields": "prowjob,filename",
+		"_msg_field":     "requestURI",
+	} {
+		if req.Query[param] != expected {
+			t.Errorf("expected %s=%s, got %q", param, expected, req.Query[param])
+		}
+	}
+	if req.ContentType != "application/stream+json" {
+		t.Errorf("unexpected content type %s", req.ContentType)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(req.Body))
+	for scanner.Scan() {
+		lines++
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		for field, expected := range map[string]string{
+			"user.username":      "system:admin",
+			"objectRef.resource": "pods",
+			"prowjob":            "job-1",
+			"filename":           "audit.log",
+			vlogsTimeField:       "2024-09-16T10:00:00.1Z",
+		} {
+			if record[field] != expected {
+				t.Errorf("expected %s=%s, got %v", field, expected, record[field])
+			}
+		}
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 lines, got %d", lines)
+	}
+}
+
+func TestVlogsSinkOmitsEmptyParams(t *testing.T) {
+	server, requests := recordingServer(t)
+	sink, err := newVlogsClient(testLogger(), VlogsConfig{PushURL: server.URL + "/insert/jsonline?debug=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteBatch([]auditapi.Event{{Verb: "get"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	query := requests()[0].Query
+	if _, ok := query["_stream_fields"]; ok {
+		t.Errorf("expected no _stream_fields, got %v", query)
+	}
+	if _, ok := query["_msg_field"]; ok {
+		t.Errorf("expected no _msg_field, got %v", query)
+	}
+	if query["debug"] != "1" || query["_time_field"] != vlogsTimeField {
+		t.Errorf("expected existing query params to be kept, got %v", query)
+	}
+}
+
+func TestVlogsSinkMaxRequestSize(t *testing.T) {
+	server, requests := recordingServer(t)
+	event := auditapi.Event{Verb: "get", RequestURI: "/api/v1/pods"}
+	record, err := flattenEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record[vlogsTimeField] = event.StageTimestamp.UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two and a half lines fit into a request
+	maxSize := (len(line) + 1) * 5 / 2
+	sink, err := newVlogsClient(testLogger(), VlogsConfig{PushURL: server.URL, MaxRequestSize: maxSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteBatch([]auditapi.Event{event, event, event, event, event}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	received := requests()
+	if len(received) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(received))
+	}
+	for _, req := range received {
+		if len(req.Body) > maxSize {
+			t.Errorf("request of %d bytes exceeds limit of %d", len(req.Body), maxSize)
+		}
+	}
+	if sink.Acknowledged() != 5 {
+		t.Errorf("expected 5 acknowledged events, got %d", sink.Acknowledged())
+	}
+}
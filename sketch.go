@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// sketchRelativeAccuracy is the maximum relative error of quantiles estimated by quantileSketch
+const sketchRelativeAccuracy = 0.01
+
+// quantileSketch estimates quantiles of a stream of positive values in bounded memory.
+// Values are counted in logarithmic buckets, so any quantile is within sketchRelativeAccuracy
+// of the exact one. Sketches of different streams can be merged without losing accuracy
+type quantileSketch struct {
+	buckets   map[int]uint64
+	zeroCount uint64
+	count     uint64
+	sum       float64
+	min       float64
+	max       float64
+}
+
+// sketchGamma is the ratio of bucket bounds
+var sketchGamma = (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+
+func newQuantileSketch() *quantileSketch {
+	return &quantileSketch{buckets: map[int]uint64{}}
+}
+
+// Add counts the value, negative values are counted as zero
+func (s *quantileSketch) Add(value float64) {
+	if value < 0 || math.IsNaN(value) {
+		value = 0
+	}
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count++
+	s.sum += value
+	if value == 0 {
+		s.zeroCount++
+		return
+	}
+	s.buckets[int(math.Ceil(math.Log(value)/math.Log(sketchGamma)))]++
+}
+
+// Merge adds all values counted by other sketch
+func (s *quantileSketch) Merge(other *quantileSketch) {
+	if other.count == 0 {
+		return
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	s.zeroCount += other.zeroCount
+	for index, count := range other.buckets {
+		s.buckets[index] += count
+	}
+}
+
+// Quantile returns estimated value at quantile q between 0 and 1
+func (s *quantileSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+	rank := uint64(q * float64(s.count-1))
+	seen := s.zeroCount
+	if rank < seen {
+		return 0
+	}
+	indexes := make([]int, 0, len(s.buckets))
+	for index := range s.buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		seen += s.buckets[index]
+		if rank < seen {
+			// Middle of the bucket has the lowest relative error, it must not be out of observed range
+			value := 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+			return math.Max(s.min, math.Min(s.max, value))
+		}
+	}
+	return s.max
+}
+
+// Count returns number of values added
+func (s *quantileSketch) Count() uint64 {
+	return s.count
+}
+
+// Sum returns sum of values added
+func (s *quantileSketch) Sum() float64 {
+	return s.sum
+}
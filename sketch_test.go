@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestQuantileSketchAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	values := make([]float64, 10000)
+	sketch := newQuantileSketch()
+	for i := range values {
+		// Latencies are long-tailed
+		values[i] = math.Exp(rng.NormFloat64()*2 + 3)
+		sketch.Add(values[i])
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		exact := values[int(q*float64(len(values)-1))]
+		estimated := sketch.Quantile(q)
+		if math.Abs(estimated-exact)/exact > sketchRelativeAccuracy {
+			t.Errorf("p%v: expected %v within %v, got %v", q*100, exact, sketchRelativeAccuracy, estimated)
+		}
+	}
+	if sketch.Quantile(1) != values[len(values)-1] || sketch.Quantile(0) != values[0] {
+		t.Errorf("expected exact min and max, got %v and %v", sketch.Quantile(0), sketch.Quantile(1))
+	}
+	if sketch.Count() != uint64(len(values)) {
+		t.Errorf("expected %d values, got %d", len(values), sketch.Count())
+	}
+}
+
+func TestQuantileSketchMerge(t *testing.T) {
+	whole, left, right := newQuantileSketch(), newQuantileSketch(), newQuantileSketch()
+	for i := 0; i < 1000; i++ {
+		value := float64(i)
+		whole.Add(value)
+		if i%2 == 0 {
+			left.Add(value)
+		} else {
+			right.Add(value)
+		}
+	}
+	left.Merge(right)
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		if left.Quantile(q) != whole.Quantile(q) {
+			t.Errorf("q%v: expected merged sketch to match %v, got %v", q, whole.Quantile(q), left.Quantile(q))
+		}
+	}
+	if left.Sum() != whole.Sum() || left.Count() != whole.Count() {
+		t.Errorf("expected merged sum %v and count %d, got %v and %d", whole.Sum(), whole.Count(), left.Sum(), left.Count())
+	}
+}
+
+func TestQuantileSketchEmpty(t *testing.T) {
+	if value := newQuantileSketch().Quantile(0.5); value != 0 {
+		t.Errorf("expected 0 for empty sketch, got %v", value)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// openArtifact streams the artifact from the URL. If the cache is set and caches streamed artifacts,
+// cached copy is used or the artifact is written to the cache while it's read
+func openArtifact(ctx context.Context, cache *downloadCache, artifactURL string) (io.ReadCloser, error) {
+	if cache != nil && cache.streamed {
+		return cache.Open(ctx, artifactURL)
+	}
+	return fetchArtifact(ctx, artifactURL)
+}
+
+// fetchArtifact streams the artifact from the URL without storing it on disk
+func fetchArtifact(ctx context.Context, artifactURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, artifactURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Tarballs take a while to read, so the client has no timeout
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", artifactURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %s: returned %s", artifactURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// isAuditLogMember returns true if archive member is an audit log of a node, e.g. <node>/<apiserver>-audit-<time>.log.gz
+// or must-gather's audit_logs/<apiserver>/<node>/<file>.log.gz
+func isAuditLogMember(name string) bool {
+	segments := strings.Split(name, "/")
+	if len(segments) < 2 {
+		return false
+	}
+	if strings.Contains(name, "-audit") {
+		return true
+	}
+	return len(segments) >= 4 && segments[len(segments)-4] == mustGatherAuditLogsDir &&
+		(strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz"))
+}
+
+// archiveMemberName returns name of audit log streamed from archive member, same as untarIt extracts it to
+func archiveMemberName(memberName string) string {
+	return strings.TrimSuffix(archiveMemberPath(memberName), ".gz")
+}
+
+// auditLogMemberName returns name of audit log streamed from tarball member, same as path it's extracted to
+func auditLogMemberName(tarball auditLogsTar, memberName string) string {
+	return path.Join(tarball.Target, tarball.Step, archiveMemberName(memberName))
+}
+
+// auditLogMemberID identifies archive member in import state
+func auditLogMemberID(source, memberName string, size int64) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", source, memberName, size)))
+	return hex.EncodeToString(hash[:])
+}
+
+// archiveIngest sends audit logs from archive members to sinks one by one and collects the results
+type archiveIngest struct {
+	logger   *logrus.Logger
+	sinks    *sinkTracker
+	conf     IngestConfig
+	source   string
+	labels   map[string]string
+	errs     []error
+	members  []string
+	badLines map[string]int
+}
+
+func newArchiveIngest(logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, source string, labels map[string]string) *archiveIngest {
+	conf.FileLabels = map[string]map[string]string{}
+	return &archiveIngest{
+		logger:   logger,
+		sinks:    sinks,
+		conf:     conf,
+		source:   source,
+		labels:   labels,
+		badLines: map[string]int{},
+	}
+}
+
+// Ingest sends audit log of the archive member stored as name
+func (a *archiveIngest) Ingest(ctx context.Context, memberName, name string, size int64, open openFunc) {
+	a.members = append(a.members, name)
+	a.conf.FileLabels[name] = a.labels
+	var imp *fileImport
+	if a.conf.State != nil {
+		imp = a.conf.State.BeginStream(a.conf.ProwJob, name, auditLogMemberID(a.source, memberName, size), size, a.conf.Force)
+	}
+	stats, err := ingestAuditLog(ctx, a.logger, a.sinks, a.conf, name, open, imp)
+	if err != nil {
+		a.errs = append(a.errs, err)
+	}
+	if stats.BadLines > 0 {
+		a.badLines[name] = stats.BadLines
+	}
+	a.logger.WithFields(logrus.Fields{"path": name, "processed": len(a.members)}).Info("File processed")
+}
+
+// Fail records error reading the archive
+func (a *archiveIngest) Fail(err error) {
+	a.errs = append(a.errs, fmt.Errorf("failed to read %s: %v", a.source, err))
+}
+
+// Finish prints summary of malformed lines and returns errors of all members
+func (a *archiveIngest) Finish(ctx context.Context) error {
+	printBadLinesSummary(a.logger, a.members, a.badLines)
+	return errors.Join(append(a.errs, ctx.Err())...)
+}
+
+// streamTarMembers sends audit logs from members of tar archive, named by memberName.
+// Members are read one by one as they appear in the archive
+func streamTarMembers(ctx context.Context, a *archiveIngest, archive io.Reader, memberName func(string) string) {
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			a.Fail(err)
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg || !isAuditLogMember(hdr.Name) {
+			continue
+		}
+		// Members are compressed audit logs, unread rest of the member is skipped by tar reader
+		open := func() (io.ReadCloser, error) { return decompress(tr) }
+		a.Ingest(ctx, hdr.Name, memberName(hdr.Name), hdr.Size, open)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// streamAuditLogsTar sends audit logs from Prow tarball members to sinks without extracting them to disk
+func streamAuditLogsTar(ctx context.Context, logger *logrus.Logger, sinks *sinkTracker, conf IngestConfig, cache *downloadCache, tarball auditLogsTar, labels map[string]string) error {
+	body, err := openArtifact(ctx, cache, tarball.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	archive, err := decompress(body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", tarball.URL, err)
+	}
+	defer archive.Close()
+
+	logger.WithFields(logrus.Fields{"url": tarball.URL}).Info("Streaming audit logs")
+	a := newArchiveIngest(logger, sinks, conf, tarball.URL, labels)
+	streamTarMembers(ctx, a, archive, func(name string) string { return auditLogMemberName(tarball, name) })
+	return a.Finish(ctx)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStreamAuditLogsTar(t *testing.T) {
+	tarball := testAuditLogsTar(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "audit-logs.tar", time.Now(), bytes.NewReader(tarball))
+	}))
+	t.Cleanup(server.Close)
+
+	state, err := loadImportState(filepath.Join(t.TempDir(), "imports.json"), testSinkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := IngestConfig{
+		SinkName: testSinkName,
+		ProwJob:  "job",
+		Parse:    failOnParseError,
+		State:    state,
+	}
+	tar := auditLogsTar{URL: server.URL + "/audit-logs.tar", Target: "e2e-aws", Step: "gather-audit-logs"}
+	stream := func() {
+		t.Helper()
+		sinks := newSinkTracker(testLogger())
+		if err := streamAuditLogsTar(context.Background(), testLogger(), sinks, conf, nil, tar, tar.Labels()); err != nil {
+			t.Fatal(err)
+		}
+		if err := sinks.CloseAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resetRecordedSinks()
+	stream()
+	recordedSinks.Lock()
+	if len(recordedSinks.sinks) != 1 {
+		t.Fatalf("expected 1 stream, got %d", len(recordedSinks.sinks))
+	}
+	labels := recordedSinks.labels[0]
+	if labels["filename"] != "e2e-aws/gather-audit-logs/kube-apiserver/master-0-audit.log" || labels["step"] != "gather-audit-logs" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	if events := len(recordedSinks.sinks[0].events); events != 2 {
+		t.Errorf("expected 2 events, got %d", events)
+	}
+	recordedSinks.Unlock()
+
+	// Members imported already are skipped
+	stream()
+	recordedSinks.Lock()
+	defer recordedSinks.Unlock()
+	if len(recordedSinks.sinks) != 1 {
+		t.Errorf("expected imported member to be skipped, got %d streams", len(recordedSinks.sinks))
+	}
+}
+
+func TestStreamAuditLogsTarOfSeveralRuns(t *testing.T) {
+	tarball := testAuditLogsTar(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "audit-logs.tar", time.Now(), bytes.NewReader(tarball))
+	}))
+	t.Cleanup(server.Close)
+
+	tar := auditLogsTar{URL: server.URL + "/audit-logs.tar", Target: "e2e-aws", Step: "gather-audit-logs"}
+	sinks := newSinkTracker(testLogger())
+	for _, run := range []string{"https://prow.example.com/run/1", "https://prow.example.com/run/2"} {
+		conf := IngestConfig{SinkName: testSinkName, ProwJob: run, Parse: failOnParseError}
+		if err := streamAuditLogsTar(context.Background(), testLogger(), sinks, conf, nil, tar, tar.Labels()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sinks.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Members with the same name in different runs must be tracked separately
+	acked := 0
+	for _, sink := range sinks.closed {
+		acked += sink.Acknowledged()
+	}
+	if len(sinks.closed) != 2 || acked != 4 {
+		t.Errorf("expected 2 tracked streams with 4 events, got %d with %d", len(sinks.closed), acked)
+	}
+}